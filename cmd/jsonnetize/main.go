@@ -1,315 +1,669 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
-	"gopkg.in/yaml.v1"
-	"sigs.k8s.io/kustomize/api/types"
+	"github.com/dmarkwat/jsonnetize/pkg/jsonnetize"
+	"gopkg.in/yaml.v3"
 )
 
-const (
-	ResourceType KustomizeType = iota
-	PluginType
-)
+// stringSlice is a flag.Value collecting every occurrence of a repeatable flag.
+type stringSlice []string
 
-var kustTypeMap = map[KustomizeType]string{
-	ResourceType: "Resource",
-	PluginType:   "Plugin",
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
 }
 
-type KustomizeType uint
-
-func (k KustomizeType) String() string {
-	return kustTypeMap[k]
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
-type Jsonnetizer struct {
-	Base   string
-	Output string
-}
+// Exit statuses, telling apart what caused a failure.
+const (
+	exitFailure   = 1
+	exitJsonnet   = 2
+	exitKustomize = 3
+	exitConfig    = 4
+)
 
-func (j *Jsonnetizer) QualifyOutput(root, path string) string {
-	return filepath.Join(j.Output, root, path)
+func main() {
+	os.Exit(run(os.Args))
 }
 
-func processFileRef(j *Jsonnetizer, root, path string) (string, error) {
-	qPath := filepath.Join(root, path)
-	if !isLocalFile(qPath) {
-		log.Printf("%s is not a local file; leaving it alone", qPath)
-		return path, nil
-	} else if isJsonnetFile(qPath) && !filepath.IsAbs(path) {
-		log.Printf("Running jsonnet on %s", qPath)
+// fail logs err, returning the status to exit with for it.
+func fail(err error) int {
+	log.Println(err)
+	return exitStatus(err)
+}
 
-		outputFile := j.QualifyOutput(root, path) + ".yml"
-		err := os.MkdirAll(filepath.Dir(outputFile), os.ModePerm)
-		if err != nil {
-			return "", err
-		}
+// exitStatus returns the status to exit with for err.
+func exitStatus(err error) int {
+	var jsonnetErr *jsonnetize.JsonnetError
+	var kustomizeErr *jsonnetize.KustomizeError
+	var configErr *jsonnetize.ConfigError
+	switch {
+	case errors.As(err, &jsonnetErr):
+		return exitJsonnet
+	case errors.As(err, &kustomizeErr):
+		return exitKustomize
+	case errors.As(err, &configErr):
+		return exitConfig
+	}
+	return exitFailure
+}
 
-		updatedPath := path + ".yml"
-		cmd := exec.Command("jsonnet", "-o", outputFile, qPath)
-		stdoutStderr, err := cmd.CombinedOutput()
-		if len(stdoutStderr) > 0 {
-			log.Printf("%s", stdoutStderr)
-		}
+// run runs jsonnetize with osArgs, which are in the form of os.Args, returning
+// the status to exit with.
+func run(osArgs []string) int {
+	flags := flag.NewFlagSet(osArgs[0], flag.ContinueOnError)
+	var output string
+	var base string
+	var jpaths stringSlice
+	var extStrs, extCodes stringSlice
+	var extStrFiles, extCodeFiles stringSlice
+	var tlaStrs, tlaCodes stringSlice
+	var multi bool
+	var include, exclude stringSlice
+	var ignore stringSlice
+	var stripJsonnetExt bool
+	var validate bool
+	var krm bool
+	var allowEscape bool
+	var restrictImports bool
+	var copySiblings bool
+	var inline bool
+	var keepGoing bool
+	var format, outputExt string
+	var lineEnding string
+	var dirMode string
+	var jobs int
+	var buildConcurrency int
+	var dryRun, noBuild bool
+	var check bool
+	var clean bool
+	var requireEmptyOutput bool
+	var verbose bool
+	var trace bool
+	var progress bool
+	var failOnWarning bool
+	var enableAlphaPlugins bool
+	var rootExtStr string
+	var jsonnetBin, kustomizeBin string
+	var buildOutput string
+	var retries int
+	var env stringSlice
+	var kustomizeFlags stringSlice
+	var kustomizeArgs string
+	var preExec string
+	var report string
+	var dumpTree string
+	var diagnosticsJSON string
+	var bundle string
+	var timeout time.Duration
+	var since string
+	var watch bool
+	var printConfig bool
+	var cacheDir string
+	var noCache bool
+
+	flags.StringVar(&output, "output", "", "location to replicate the kustomization (defaults to a temp dir)")
+	flags.StringVar(&base, "base", "", "directory whose tree the output mirrors, which every kustomization must be within (defaults to mirroring full paths)")
+	flags.Var(&jpaths, "jpath", "jsonnet library search path, relative to the kustomization root (repeatable)")
+	flags.Var(&extStrs, "ext-str", "jsonnet external string variable as key=value, or key to read from the environment (repeatable)")
+	flags.Var(&extCodes, "ext-code", "jsonnet external code variable as key=expr, or key to read from the environment (repeatable)")
+	flags.Var(&extStrFiles, "ext-str-file", "jsonnet external string variable as key=path, read from the file (repeatable)")
+	flags.Var(&extCodeFiles, "ext-code-file", "jsonnet external code variable as key=path, read from the file (repeatable)")
+	flags.Var(&tlaStrs, "tla-str", "jsonnet top-level string argument as key=value, or key to read from the environment (repeatable)")
+	flags.Var(&tlaCodes, "tla-code", "jsonnet top-level code argument as key=expr, or key to read from the environment (repeatable)")
+	flags.StringVar(&rootExtStr, "root-ext-str", "", "jsonnet external string variable to set to the root of the kustomization each file is under, e.g. kustomizeRoot for std.extVar('kustomizeRoot')")
+	flags.StringVar(&jsonnetBin, "jsonnet-bin", "", "jsonnet binary to run (defaults to $JSONNET_BIN, then jsonnet)")
+	flags.StringVar(&preExec, "pre-exec", "", "command, split on spaces, to pipe each jsonnet file compiled through before jsonnet evaluates it, e.g. envsubst; $JSONNETIZE_FILE holds the file's path")
+	flags.StringVar(&kustomizeBin, "kustomize-bin", "", "kustomize command to run, e.g. \"kubectl kustomize\" (defaults to $KUSTOMIZE_BIN, then kustomize)")
+	flags.StringVar(&kustomizeArgs, "kustomize-args", "", "arguments to run kustomize with in place of build, its flags and the root, split on spaces, with {{root}} standing for the root, e.g. 'build --reorder none {{root}}'")
+	flags.Var(&kustomizeFlags, "kustomize-flag", "flag to pass to kustomize build, with any value as --flag=value, e.g. --reorder=none (repeatable)")
+	flags.StringVar(&buildOutput, "build-output", "", "file to write the kustomize build output to (defaults to stdout)")
+	flags.Var(&env, "env", "environment variable to set for kustomize as KEY=VALUE, e.g. KUSTOMIZE_PLUGIN_HOME=plugins (repeatable)")
+	flags.IntVar(&retries, "retries", 0, "retry a kustomize build failing for reasons other than its input up to this many times, with exponential backoff")
+	flags.StringVar(&bundle, "bundle", "", "file to write every resource of the generated tree to, as one YAML stream, before kustomize runs")
+	flags.StringVar(&since, "since", "", "RFC3339 time to keep the output of jsonnet files last modified before, along with their imports, rather than compiling them again")
+	flags.StringVar(&diagnosticsJSON, "diagnostics-json", "", "file, or - for stderr, to write where and why jsonnet failed to as a JSON array of file, line, column and message, rather than logging it; written empty when nothing failed")
+	flags.StringVar(&report, "report", "", "file to write a JSON report of what was done with each file to")
+	flags.StringVar(&dumpTree, "dump-tree", "", "file to write the kustomizations processed to as a JSON array of trees, one per root, giving the paths each refers to as written and as rewritten")
+	flags.BoolVar(&enableAlphaPlugins, "enable-alpha-plugins", true, "enable kustomize alpha plugins during the build")
+	flags.IntVar(&jobs, "jobs", runtime.GOMAXPROCS(0), "number of paths to process concurrently")
+	flags.IntVar(&buildConcurrency, "build-concurrency", 1, "number of kustomizations to run kustomize build on concurrently, once every one is processed; their output is written in the order of the roots")
+	flags.DurationVar(&timeout, "timeout", 0, "give up, killing any jsonnet or kustomize process, after this long (0 means no limit)")
+	flags.StringVar(&cacheDir, "cache-dir", "", "directory to cache jsonnet output in (defaults to jsonnetize in the user cache dir)")
+	flags.BoolVar(&noCache, "no-cache", false, "evaluate every jsonnet file, neither reading nor writing the cache")
+	flags.BoolVar(&watch, "watch", false, "keep running, rebuilding whenever a jsonnet, libsonnet or kustomization file changes")
+	flags.BoolVar(&printConfig, "print-config", false, "print the effective configuration, with every flag and environment variable resolved, and exit")
+	flags.BoolVar(&dryRun, "dry-run", false, "print the actions that would be taken without evaluating or writing anything")
+	flags.BoolVar(&check, "check", false, "check that the -output tree is what this run would write, printing how it differs and exiting with status 1 if not, without changing it")
+	flags.BoolVar(&requireEmptyOutput, "require-empty-output", false, "refuse to run unless this run's output root under the -output is empty or absent")
+	flags.BoolVar(&clean, "clean", false, "remove this run's output root before writing anything")
+	flags.BoolVar(&noBuild, "no-build", false, "only generate the kustomization tree, printing its root instead of running kustomize build")
+	flags.BoolVar(&verbose, "v", false, "log detailed progress")
+	flags.BoolVar(&failOnWarning, "fail-on-warning", false, "fail on jsonnet files which write warnings, such as those of std.trace, even when jsonnet succeeds")
+	flags.BoolVar(&progress, "progress", false, "log a running count of the paths processed out of those found so far")
+	flags.BoolVar(&trace, "trace", false, "log where each import of the jsonnet files evaluated resolves to")
+	flags.StringVar(&outputExt, "output-ext", "", "extension given to jsonnet output, e.g. .yaml; defaults to .yml, or .json with -format json")
+	flags.StringVar(&format, "format", string(jsonnetize.FormatYAML), "form to write jsonnet output in: yaml, json, or yaml-stream for files evaluating to an array of documents; files named like foo.json.jsonnet or foo.yaml.jsonnet are written in the format, and with the extension, they name")
+	flags.StringVar(&dirMode, "dir-mode", "0755", "octal permissions to create output directories with, before the umask")
+	flags.StringVar(&lineEnding, "line-ending", string(jsonnetize.LineEndingLF), "line endings to write text files with: lf, crlf, or keep to leave them as they are")
+	flags.BoolVar(&krm, "krm", false, "check that jsonnet generators and transformers compile to a KRM function ResourceList of Kubernetes resources")
+	flags.BoolVar(&validate, "validate", false, "check that jsonnet resources compile to documents with an apiVersion and kind")
+	flags.BoolVar(&inline, "inline", false, "experimental: embed compiled jsonnet patches in the kustomization rather than referring to their files; resources are never embedded, kustomize having no inline form of them")
+	flags.BoolVar(&copySiblings, "copy-siblings", false, "copy the whole directory of each generator and transformer config file, for the files it refers to; a config beside its kustomization file copies the whole root")
+	flags.BoolVar(&keepGoing, "keep-going", false, "process every path possible, reporting all failures at the end rather than stopping at the first")
+	flags.BoolVar(&restrictImports, "restrict-imports", false, "refuse jsonnet files importing absolute paths, or paths outside their kustomization root and the jpaths")
+	flags.BoolVar(&allowEscape, "allow-escape", false, "let kustomizations refer to files outside their root, building with kustomize's --load-restrictor=LoadRestrictionsNone")
+	flags.BoolVar(&stripJsonnetExt, "strip-jsonnet-ext", false, "name jsonnet output foo.yml rather than foo.jsonnet.yml")
+	flags.Var(&include, "include", "only compile jsonnet files matching this glob, relative to their kustomization root (repeatable)")
+	flags.Var(&ignore, "ignore", "skip files and directories matching this glob, by name or path relative to their kustomization root, when copying a directory; a .jsonnetizeignore file in the root adds its own (repeatable)")
+	flags.Var(&exclude, "exclude", "copy jsonnet files matching this glob, relative to their kustomization root, rather than compiling them (repeatable)")
+	flags.BoolVar(&multi, "multi", false, "split jsonnet resources evaluating to an array into one file per element")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s [flags] <kustomization root, file, or - for stdin>...
+       %[1]s eval [flags] <jsonnet file>
+
+Several kustomizations are each processed and built in turn, sharing the
+output; the first to fail stops the rest unless -keep-going is given.
+
+A kustomization read from stdin is processed in a temporary root, so the
+local files it refers to won't resolve; only remote references and inline
+content can be used.
+
+eval prints the output of a single jsonnet file, evaluated as it would be
+during a build, without a kustomization or kustomize. Relative -jpath
+directories are relative to the file's directory.
+
+Failures exit with status 2 if jsonnet failed, 3 if kustomize did, 4 if the
+configuration is unusable and 1 otherwise.
+
+`, osArgs[0])
+		flags.PrintDefaults()
+	}
+	// eval is the only subcommand, and takes the same flags
+	evalFile := len(osArgs) > 1 && osArgs[1] == "eval"
+	flagArgs := osArgs[1:]
+	if evalFile {
+		flagArgs = osArgs[2:]
+	}
+	err := flags.Parse(flagArgs)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return exitConfig
+	}
+
+	if output == "" && check {
+		return fail(&jsonnetize.ConfigError{Err: errors.New("-check needs the -output to check")})
+	}
+	// a temporary output is always empty, and cleaning always empties it
+	if output == "" && requireEmptyOutput {
+		return fail(&jsonnetize.ConfigError{Err: errors.New("-require-empty-output needs the -output to check")})
+	}
+	if clean && requireEmptyOutput {
+		return fail(&jsonnetize.ConfigError{Err: errors.New("-require-empty-output refuses the output -clean would remove; give only one")})
+	}
+	if output == "" && dryRun {
+		output = filepath.Join(os.TempDir(), "jsonnetize-dry-run")
+	} else if output == "" && !printConfig && !evalFile {
+		// printing the configuration leaves the output empty, meaning a
+		// new temporary directory, rather than creating one; eval writes
+		// nothing at all
+		var tmp string
+		tmp, err = os.MkdirTemp("", "jsonnetize-")
 		if err != nil {
-			return "", err
+			return fail(err)
 		}
-		return updatedPath, err
-	} else {
-		return path, copyFile(qPath, j.QualifyOutput(root, path))
+		output = tmp
 	}
-}
 
-func isLocalFile(path string) bool {
-	parse, err := url.Parse(path)
-	if err != nil {
-		return false
+	logger := jsonnetize.NewLogger(os.Stderr, verbose)
+	if !evalFile {
+		logger.Printf("Output directory: %s", output)
 	}
-	return parse.Scheme == "" || parse.Scheme == "file"
-}
 
-func isJsonnetFile(path string) bool {
-	return strings.LastIndex(path, ".jsonnet") == len(path)-8
-}
-
-func copyFile(src, dest string) error {
-	// todo emulate same perms
-	err := os.MkdirAll(filepath.Dir(dest), os.ModePerm)
-	if err != nil {
-		return err
-	}
-	open, err := os.Open(src)
-	if err != nil {
-		return err
+	args := flags.Args()
+	if len(args) == 0 {
+		return fail(&jsonnetize.ConfigError{Err: errors.New("Not enough args")})
 	}
-	defer open.Close()
 
-	create, err := os.Create(dest)
-	if err != nil {
-		return err
+	var kustRoots []string
+	if evalFile {
+		kustRoots = []string{filepath.Dir(args[0])}
+	} else {
+		for _, arg := range args {
+			var kustRoot string
+			if arg == "-" {
+				kustRoot, err = jsonnetize.KustRootFromReader(os.Stdin)
+				if err != nil {
+					return fail(err)
+				}
+				defer os.RemoveAll(kustRoot)
+			} else {
+				kustRoot, err = jsonnetize.ResolveKustRoot(arg)
+				if err != nil {
+					return fail(err)
+				}
+			}
+			kustRoots = append(kustRoots, kustRoot)
+		}
 	}
-	defer create.Close()
-
-	_, err = io.Copy(create, open)
-	if err != nil {
-		return err
+	if watch && len(kustRoots) > 1 {
+		return fail(&jsonnetize.ConfigError{Err: errors.New("-watch takes a single kustomization")})
 	}
 
-	return nil
-}
-
-func processResource(j *Jsonnetizer, root, path string) (string, error) {
-	si, err := os.Lstat(filepath.Join(root, path))
+	resolvedJsonnetBin, err := jsonnetize.ResolveBin(jsonnetBin, "JSONNET_BIN", "jsonnet")
 	if err != nil {
-		return "", err
+		return fail(err)
 	}
 
-	if si.IsDir() {
-		err = processKustomization(j, root, path)
+	// eval never runs kustomize, so needn't have it installed
+	var resolvedKustomizeCmd []string
+	var alphaPluginsFlag string
+	if !evalFile {
+		resolvedKustomizeCmd, err = jsonnetize.ResolveCommand(kustomizeBin, "KUSTOMIZE_BIN", "kustomize")
 		if err != nil {
-			return "", err
+			return fail(err)
 		}
-	} else {
-		updatedPath, err := processFileRef(j, root, path)
-		if err != nil {
-			return "", err
+		if enableAlphaPlugins {
+			alphaPluginsFlag = jsonnetize.DetectAlphaPluginsFlag(logger, resolvedKustomizeCmd)
 		}
-		return updatedPath, nil
 	}
-	return path, nil
-}
-
-func processPlugin(j *Jsonnetizer, root, path string) (string, error) {
-	return processFileRef(j, root, path)
-}
-
-func runKustomize(root string) error {
-	cmd := exec.Command("kustomize", "build", "--enable_alpha_plugins", root)
 
-	cmd.Stdout = os.Stdout
-
-	stderr, err := cmd.StderrPipe()
+	resolvedExtStrs, err := jsonnetize.ResolveExtVars(extStrs)
 	if err != nil {
-		return fmt.Errorf("couldn't open stderr pipe: %w", err)
+		return fail(err)
 	}
-
-	err = cmd.Start()
+	resolvedExtCodes, err := jsonnetize.ResolveExtVars(extCodes)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-
-	stderrOut, err := ioutil.ReadAll(stderr)
+	resolvedExtStrFiles, err := jsonnetize.ResolveVarFiles(extStrFiles)
 	if err != nil {
-		return fmt.Errorf("couldn't read stderr: %w", err)
-	}
-
-	if len(stderrOut) > 0 {
-		log.Println(string(stderrOut))
+		return fail(err)
 	}
-
-	if err = cmd.Wait(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func processTypes(j *Jsonnetizer, root string, kustType KustomizeType, paths []string) ([]string, error) {
-	var finalResources []string
-	for _, path := range paths {
-		if path == "" {
-			return nil, fmt.Errorf("empty path as %s", root)
-		}
-		var err error
-		var updatedPath string
-		log.Printf("Processing %s: %s", kustType.String(), path)
-		switch kustType {
-		case ResourceType:
-			updatedPath, err = processResource(j, root, path)
-		case PluginType:
-			updatedPath, err = processPlugin(j, root, path)
-		}
-		if err != nil {
-			return nil, err
-		}
-		finalResources = append(finalResources, updatedPath)
-	}
-	return finalResources, nil
-}
-
-func findKustFile(root string) (string, error) {
-	path := filepath.Join(root, "kustomization.yml")
-	si, err := os.Stat(path)
+	resolvedExtCodeFiles, err := jsonnetize.ResolveVarFiles(extCodeFiles)
 	if err != nil {
-		path = filepath.Join(root, "kustomization.yaml")
-		si, err = os.Stat(path)
-		if err != nil {
-			return "", fmt.Errorf("couldn't find kustomization file in %s", root)
-		}
+		return fail(err)
 	}
-	if !si.Mode().IsRegular() {
-		return "", fmt.Errorf("%s is not a file", path)
-	}
-	return path, nil
-}
-
-func processKustomization(j *Jsonnetizer, oldRoot, resource string) error {
-	root := filepath.Join(oldRoot, resource)
-	kust, err := findKustFile(root)
+	resolvedTLAStrs, err := jsonnetize.ResolveExtVars(tlaStrs)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-
-	bytes, err := ioutil.ReadFile(kust)
+	resolvedTLACodes, err := jsonnetize.ResolveExtVars(tlaCodes)
 	if err != nil {
-		return err
+		return fail(err)
 	}
 
-	var kustomization types.Kustomization
-	err = yaml.Unmarshal(bytes, &kustomization)
+	kustomizeEnv, err := jsonnetize.ParseEnv(env)
 	if err != nil {
-		return err
+		return fail(err)
 	}
 
-	// process and replace filenames:
-	// resources
-	resources, err := processTypes(j, root, ResourceType, kustomization.Resources)
+	outputFormat, err := jsonnetize.ParseFormat(format)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	kustomization.Resources = resources
-
-	// generators
-	generators, err := processTypes(j, root, PluginType, kustomization.Generators)
+	outputLineEnding, err := jsonnetize.ParseLineEnding(lineEnding)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	kustomization.Generators = generators
-
-	// transformers
-	transformers, err := processTypes(j, root, PluginType, kustomization.Transformers)
+	outputDirMode, err := jsonnetize.ParseDirMode(dirMode)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	kustomization.Transformers = transformers
-
-	output := j.QualifyOutput(kust, "")
-	f, err := os.Create(output)
+	resolvedKustomizeArgs, err := jsonnetize.ParseKustomizeArgs(kustomizeArgs)
 	if err != nil {
-		return err
+		return fail(err)
+	}
+	var sinceTime time.Time
+	if since != "" {
+		sinceTime, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return fail(&jsonnetize.ConfigError{Err: fmt.Errorf("bad -since time: %w", err)})
+		}
 	}
 
-	bytes, err = yaml.Marshal(kustomization)
-	if err != nil {
-		return err
+	if noCache {
+		cacheDir = ""
+	} else if cacheDir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			logger.Warnf("Couldn't find a cache directory, caching is disabled: %v", err)
+		} else {
+			cacheDir = filepath.Join(userCache, "jsonnetize")
+		}
 	}
 
-	_, err = f.Write(bytes)
-	if err != nil {
-		return err
+	j := jsonnetize.Jsonnetizer{
+		Base:     base,
+		Output:   output,
+		JPaths:   jsonnetize.ResolveJPaths(kustRoots[0], jpaths),
+		ExtStrs:  resolvedExtStrs,
+		ExtCodes: resolvedExtCodes,
+		TLAStrs:  resolvedTLAStrs,
+		TLACodes: resolvedTLACodes,
+
+		ExtStrFiles:  resolvedExtStrFiles,
+		ExtCodeFiles: resolvedExtCodeFiles,
+		RootExtStr:   rootExtStr,
+
+		JsonnetBin:   resolvedJsonnetBin,
+		PreExec:      strings.Fields(preExec),
+		KustomizeCmd: resolvedKustomizeCmd,
+
+		AlphaPluginsFlag: alphaPluginsFlag,
+		KustomizeFlags:   kustomizeFlags,
+		KustomizeArgs:    resolvedKustomizeArgs,
+		BuildOutput:      buildOutput,
+		Env:              kustomizeEnv,
+		Retries:          retries,
+		Jobs:             jobs,
+		BuildConcurrency: buildConcurrency,
+		Include:          include,
+		Exclude:          exclude,
+		Ignore:           ignore,
+		Format:           outputFormat,
+		OutputExt:        outputExt,
+		LineEnding:       outputLineEnding,
+		Multi:            multi,
+		StripJsonnetExt:  stripJsonnetExt,
+		Validate:         validate,
+		KRM:              krm,
+		AllowEscape:      allowEscape,
+		Inline:           inline,
+		CopySiblings:     copySiblings,
+		KeepGoing:        keepGoing,
+		RestrictImports:  restrictImports,
+		Since:            sinceTime,
+		CacheDir:         cacheDir,
+		FailOnWarning:    failOnWarning,
+		Trace:            trace,
+		Progress:         progress,
+		DirMode:          outputDirMode,
+		DryRun:           dryRun,
+		Log:              logger,
+	}
+
+	// the jpaths are relative to each kustomization in turn
+	forRoot := func(kustRoot string) {
+		logger.Debugf("Processing kustomization: %s", kustRoot)
+		j.JPaths = jsonnetize.ResolveJPaths(kustRoot, jpaths)
+	}
+
+	// writeDiagnostics writes the diagnostics of err, none when it's nil, for
+	// -diagnostics-json, reporting whether there were any
+	writeDiagnostics := func(err error) bool {
+		if diagnosticsJSON == "" {
+			return false
+		}
+		diagnostics := jsonnetize.Diagnostics(err)
+		if diagnostics == nil {
+			diagnostics = []jsonnetize.Diagnostic{}
+		}
+		data, err := json.MarshalIndent(diagnostics, "", "  ")
+		if err == nil && diagnosticsJSON == "-" {
+			_, err = os.Stderr.Write(append(data, '\n'))
+		} else if err == nil {
+			err = ioutil.WriteFile(diagnosticsJSON, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			logger.Warnf("Couldn't write diagnostics: %v", err)
+			return false
+		}
+		return len(diagnostics) > 0
+	}
+	// failJsonnet fails with err, which jsonnet may have failed with, as
+	// diagnostics rather than a log line should they be asked for
+	failJsonnet := func(err error) int {
+		if writeDiagnostics(err) {
+			return exitStatus(err)
+		}
+		return fail(err)
+	}
+
+	if printConfig {
+		// a document for each kustomization
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		for _, kustRoot := range kustRoots {
+			forRoot(kustRoot)
+			err = encoder.Encode(struct {
+				Root                    string `yaml:"root"`
+				*jsonnetize.Jsonnetizer `yaml:",inline"`
+			}{kustRoot, &j})
+			if err != nil {
+				return fail(err)
+			}
+		}
+		err = encoder.Close()
+		if err != nil {
+			return fail(err)
+		}
+		return 0
 	}
 
-	return nil
-}
+	if evalFile {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		out, err := j.Eval(ctx, args[0])
+		if err != nil {
+			return failJsonnet(err)
+		}
+		writeDiagnostics(nil)
+		_, err = os.Stdout.Write(out)
+		if err != nil {
+			return fail(err)
+		}
+		return 0
+	}
 
-func main() {
-	var output string
+	if check {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		var differences []jsonnetize.Difference
+		for _, kustRoot := range kustRoots {
+			forRoot(kustRoot)
+			rootDifferences, err := j.Check(ctx, kustRoot)
+			if err != nil {
+				return failJsonnet(err)
+			}
+			differences = append(differences, rootDifferences...)
+		}
+		writeDiagnostics(nil)
+		for _, difference := range differences {
+			fmt.Print(difference.Diff())
+		}
+		if len(differences) > 0 {
+			logger.Printf("%d files are out of date", len(differences))
+			return exitFailure
+		}
+		return 0
+	}
+
+	// build runs the whole pipeline once for every kustomization; a timeout
+	// applies to each run. Every kustomization is processed before any is
+	// built, -build-concurrency at a time, and none is built should one fail
+	// without -keep-going. The report, tree and bundle cover the
+	// kustomizations which were processed.
+	build := func() error {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
 
-	// todo needs implementing
-	flag.StringVar(&output, "output", "", "location to replicate the kustomization")
+		reports := []jsonnetize.ReportEntry{}
+		trees := []*jsonnetize.TreeNode{}
+		var bundled bytes.Buffer
+		var processed bool
+		var toBuild []string
+		processRoot := func(kustRoot string) error {
+			forRoot(kustRoot)
+			err := j.Run(ctx, kustRoot)
+			if err != nil {
+				return err
+			}
+			processed = true
+			reports = append(reports, j.Report()...)
+			trees = append(trees, j.Tree())
+
+			if bundle != "" && !j.DryRun {
+				var buf bytes.Buffer
+				err = j.Bundle(kustRoot, &buf)
+				if err != nil {
+					return fmt.Errorf("couldn't write bundle: %w", err)
+				}
+				if bundled.Len() > 0 && buf.Len() > 0 {
+					bundled.WriteString("---\n")
+				}
+				bundled.Write(buf.Bytes())
+			}
+
+			if j.DryRun {
+				for _, action := range j.Actions() {
+					fmt.Println(action)
+				}
+				return nil
+			}
+
+			if noBuild {
+				fmt.Println(j.QualifyOutput(kustRoot, ""))
+				return nil
+			}
+
+			toBuild = append(toBuild, kustRoot)
+			return nil
+		}
 
-	flag.Parse()
+		var failed jsonnetize.Errors
+		addFailure := func(kustRoot string, err error) {
+			if len(kustRoots) > 1 {
+				err = fmt.Errorf("%s: %w", kustRoot, err)
+			}
+			failed = append(failed, err)
+		}
+		for _, kustRoot := range kustRoots {
+			err := processRoot(kustRoot)
+			if err != nil {
+				addFailure(kustRoot, err)
+				if !keepGoing {
+					break
+				}
+			}
+		}
+		if len(failed) == 0 || keepGoing {
+			for i, err := range j.BuildRoots(ctx, toBuild) {
+				if err != nil {
+					addFailure(toBuild[i], err)
+				}
+			}
+		}
 
-	if output == "" {
-		pwd, err := os.Getwd()
-		if err != nil {
-			log.Fatalln(err)
+		if processed {
+			if report != "" {
+				data, err := json.MarshalIndent(reports, "", "  ")
+				if err != nil {
+					return err
+				}
+				err = ioutil.WriteFile(report, append(data, '\n'), 0644)
+				if err != nil {
+					return fmt.Errorf("couldn't write report: %w", err)
+				}
+			}
+			if dumpTree != "" {
+				data, err := json.MarshalIndent(trees, "", "  ")
+				if err != nil {
+					return err
+				}
+				err = ioutil.WriteFile(dumpTree, append(data, '\n'), 0644)
+				if err != nil {
+					return fmt.Errorf("couldn't write tree: %w", err)
+				}
+			}
+			if bundle != "" && !j.DryRun {
+				err := ioutil.WriteFile(bundle, bundled.Bytes(), 0644)
+				if err != nil {
+					return fmt.Errorf("couldn't write bundle: %w", err)
+				}
+			}
 		}
-		output = pwd
-	}
 
-	args := flag.Args()
-	if len(args) == 0 {
-		log.Fatalln("Not enough args")
+		switch len(failed) {
+		case 0:
+			return nil
+		case 1:
+			return failed[0]
+		}
+		return failed
 	}
 
-	kustRoot := args[0]
-
-	si, err := os.Stat(kustRoot)
-	if err != nil {
-		log.Fatalln(err)
+	if requireEmptyOutput {
+		for _, kustRoot := range kustRoots {
+			err = j.RequireEmptyOutput(kustRoot)
+			if err != nil {
+				return fail(err)
+			}
+		}
 	}
-
-	if !si.IsDir() {
-		if si.Name() != "kustomization.yml" || si.Name() != "kustomization.yaml" {
-			log.Fatalln("Argument must be a kustomization root or yaml file")
+	if clean {
+		for _, kustRoot := range kustRoots {
+			err = j.Clean(kustRoot)
+			if err != nil {
+				return fail(err)
+			}
 		}
-		kustRoot = filepath.Dir(kustRoot)
 	}
 
-	log.Printf("Processing kustomization: %s", kustRoot)
-
-	j := Jsonnetizer{
-		Base:   kustRoot,
-		Output: output,
+	err = build()
+	if !watch {
+		if err != nil {
+			return failJsonnet(err)
+		}
+		writeDiagnostics(nil)
+		return 0
 	}
 
-	err = processKustomization(&j, kustRoot, "")
-	if err != nil {
-		log.Fatalln(err)
+	// a broken build mustn't stop the watch: the next change may fix it.
+	// The diagnostics are rewritten after each build, clearing those fixed
+	if !writeDiagnostics(err) && err != nil {
+		logger.Warnf("%v", err)
 	}
-
-	err = runKustomize(j.QualifyOutput(kustRoot, ""))
+	logger.Printf("Watching %s for changes", kustRoots[0])
+	err = j.Watch(context.Background(), kustRoots[0], 200*time.Millisecond, func() {
+		logger.Printf("Rebuilding")
+		if err := build(); !writeDiagnostics(err) && err != nil {
+			logger.Warnf("%v", err)
+		}
+	})
 	if err != nil {
-		log.Fatalln(err)
+		return fail(err)
 	}
+	return 0
 }
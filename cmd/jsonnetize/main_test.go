@@ -1,15 +1,153 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
-func TestJsonnetizer_QualifyOutput(t *testing.T) {
-	j := Jsonnetizer{
-		Base:   "/abc/123",
-		Output: "/output/here",
+// fakeBins puts stand-in jsonnet and kustomize scripts on the PATH.
+func fakeBins(t *testing.T, jsonnet, kustomize string) {
+	bin := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(bin, "jsonnet"), []byte(jsonnet), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(bin, "kustomize"), []byte(kustomize), 0755))
+
+	path := os.Getenv("PATH")
+	assert.NoError(t, os.Setenv("PATH", bin+string(os.PathListSeparator)+path))
+	t.Cleanup(func() { _ = os.Setenv("PATH", path) })
+}
+
+func TestRun_ExitStatus(t *testing.T) {
+	const ok, built, broken = "#!/bin/sh\ncat \"$@\"\n", "#!/bin/sh\necho 'kind: A'\n", "#!/bin/sh\necho broken >&2\nexit 1\n"
+	src := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "kustomization.yml"), []byte("resources:\n- a.jsonnet\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.jsonnet"), []byte(`{"kind": "A"}`), 0644))
+
+	for name, test := range map[string]struct {
+		jsonnet, kustomize string
+		args               []string
+		status             int
+	}{
+		"success":   {ok, built, nil, 0},
+		"jsonnet":   {broken, built, nil, exitJsonnet},
+		"kustomize": {ok, broken, nil, exitKustomize},
+		"config":    {ok, built, []string{"-format", "toml"}, exitConfig},
+		"flags":     {ok, built, []string{"-no-such-flag"}, exitConfig},
+		"base":      {ok, built, []string{"-base", t.TempDir()}, exitConfig},
+		"args":      {ok, built, []string{"-no-build", "-kustomize-args", "build"}, exitConfig},
+	} {
+		fakeBins(t, test.jsonnet, test.kustomize)
+		args := append([]string{"jsonnetize", "-output", t.TempDir(), "-no-cache", "-enable-alpha-plugins=false"}, test.args...)
+		assert.Equal(t, test.status, run(append(args, src)), name)
 	}
 
-	assert.Equal(t, "/output/here/abc/123/xyz/my.resource", j.QualifyOutput("/abc/123/xyz", "my.resource"))
+	assert.Equal(t, exitConfig, run([]string{"jsonnetize", "-output", t.TempDir(), filepath.Join(src, "a.jsonnet")}))
+}
+
+func TestRun_Check(t *testing.T) {
+	fakeBins(t, "#!/bin/sh\ncat \"$@\"\n", "#!/bin/sh\n")
+	src := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "kustomization.yml"), []byte("resources:\n- a.jsonnet\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.jsonnet"), []byte(`{"kind": "A"}`), 0644))
+
+	out := t.TempDir()
+	args := []string{"jsonnetize", "-output", out, "-base", src, "-no-cache", "-enable-alpha-plugins=false"}
+	assert.Equal(t, 0, run(append(args, "-no-build", src)))
+	assert.Equal(t, 0, run(append(args, "-check", src)))
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(out, "a.jsonnet.yml"), []byte("kind: B\n"), 0644))
+	assert.Equal(t, exitFailure, run(append(args, "-check", src)))
+	data, err := ioutil.ReadFile(filepath.Join(out, "a.jsonnet.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: B\n", string(data))
+
+	assert.Equal(t, exitConfig, run([]string{"jsonnetize", "-check", src}))
+}
+
+func TestRun_RequireEmptyOutput(t *testing.T) {
+	fakeBins(t, "#!/bin/sh\ncat \"$@\"\n", "#!/bin/sh\n")
+	src := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "kustomization.yml"), []byte("resources:\n- a.jsonnet\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.jsonnet"), []byte(`{"kind": "A"}`), 0644))
+
+	out := t.TempDir()
+	args := []string{"jsonnetize", "-output", out, "-base", src, "-no-cache", "-enable-alpha-plugins=false", "-no-build", "-require-empty-output"}
+	assert.Equal(t, 0, run(append(args, src)))
+	assert.Equal(t, exitConfig, run(append(args, src)), "the first run's output is there")
+	assert.Equal(t, exitConfig, run(append(args, "-clean", src)))
+
+	assert.Equal(t, exitConfig, run([]string{"jsonnetize", "-require-empty-output", src}))
+}
+
+func TestRun_Roots(t *testing.T) {
+	fakeBins(t, "#!/bin/sh\nif grep -q error \"$@\"; then echo broken >&2; exit 1; fi\ncat \"$@\"\n", "#!/bin/sh\n")
+	src := t.TempDir()
+	for root, content := range map[string]string{"bad": "error", "good": `{"kind": "A"}`} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(src, root), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(src, root, "kustomization.yml"), []byte("resources:\n- a.jsonnet\n"), 0644))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(src, root, "a.jsonnet"), []byte(content), 0644))
+	}
+	roots := []string{filepath.Join(src, "bad"), filepath.Join(src, "good")}
+
+	// the failing root stops the rest
+	out := t.TempDir()
+	args := []string{"jsonnetize", "-output", out, "-base", src, "-no-cache", "-enable-alpha-plugins=false", "-no-build"}
+	assert.Equal(t, exitJsonnet, run(append(args, roots...)))
+	_, err := os.Stat(filepath.Join(out, "good"))
+	assert.True(t, os.IsNotExist(err))
+
+	// unless told to keep going
+	out = t.TempDir()
+	args = []string{"jsonnetize", "-output", out, "-base", src, "-no-cache", "-enable-alpha-plugins=false", "-no-build", "-keep-going"}
+	assert.Equal(t, exitJsonnet, run(append(args, roots...)))
+	data, err := ioutil.ReadFile(filepath.Join(out, "good", "a.jsonnet.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: A\n", string(data))
+
+	assert.Equal(t, 0, run(append(args, roots[1], roots[1])))
+}
+
+func TestRun_BuildOutput(t *testing.T) {
+	fakeBins(t, "#!/bin/sh\ncat \"$@\"\n", "#!/bin/sh\nfor root; do :; done\ncat \"$root/a.jsonnet.yml\"\n")
+	src := t.TempDir()
+	for root, kind := range map[string]string{"a": "A", "b": "B"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(src, root), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(src, root, "kustomization.yml"), []byte("resources:\n- a.jsonnet\n"), 0644))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(src, root, "a.jsonnet"), []byte(fmt.Sprintf(`{"kind": %q}`, kind)), 0644))
+	}
+
+	// every root's manifests are kept, in the order of the roots
+	output := filepath.Join(t.TempDir(), "manifests.yml")
+	args := []string{"jsonnetize", "-output", t.TempDir(), "-base", src, "-no-cache", "-enable-alpha-plugins=false", "-build-output", output, "-build-concurrency", "2"}
+	assert.Equal(t, 0, run(append(args, filepath.Join(src, "b"), filepath.Join(src, "a"))))
+	data, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: B\n---\nkind: A\n", string(data))
+}
+
+func TestRun_DiagnosticsJSON(t *testing.T) {
+	const broken = "#!/bin/sh\nfor last; do :; done\nprintf 'RUNTIME ERROR: boom\\n\\t%s:2:3-9\\t$\\n' \"$last\" >&2\nexit 1\n"
+	src := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "kustomization.yml"), []byte("resources:\n- a.jsonnet\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.jsonnet"), []byte("{\n  a: error 'boom',\n}\n"), 0644))
+
+	diagnostics := filepath.Join(t.TempDir(), "diagnostics.json")
+	args := []string{"jsonnetize", "-output", t.TempDir(), "-no-cache", "-enable-alpha-plugins=false", "-no-build", "-diagnostics-json", diagnostics, src}
+
+	fakeBins(t, broken, "#!/bin/sh\n")
+	assert.Equal(t, exitJsonnet, run(args))
+	data, err := ioutil.ReadFile(diagnostics)
+	assert.NoError(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`[{"file": %q, "line": 2, "column": 3, "message": "boom"}]`, filepath.Join(src, "a.jsonnet")), string(data))
+
+	// fixed, they're cleared
+	fakeBins(t, "#!/bin/sh\necho '{}'\n", "#!/bin/sh\n")
+	assert.Equal(t, 0, run(args))
+	data, err = ioutil.ReadFile(diagnostics)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[]`, string(data))
 }
@@ -1,9 +1,10 @@
 module github.com/dmarkwat/jsonnetize
 
-go 1.15
+go 1.16
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/stretchr/testify v1.4.0
-	gopkg.in/yaml.v1 v1.0.0-20140924161607-9f9df34309c0
+	gopkg.in/yaml.v3 v3.0.1
 	sigs.k8s.io/kustomize/api v0.6.0
 )
@@ -0,0 +1,89 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Bundle writes every resource file in the output of the last Run of the
+// kustomization at root to w, as one stream of YAML documents separated by
+// ---. Resources are written in the order their kustomizations list them,
+// with those of the kustomizations they refer to in place of the directory,
+// each only once. Plugin configs, patches and generator sources are left out,
+// as are remote resources.
+func (j *Jsonnetizer) Bundle(root string, w io.Writer) error {
+	if j.DryRun {
+		return &ConfigError{fmt.Errorf("a dry run writes nothing to bundle")}
+	}
+	first := true
+	return j.bundleKustomization(root, w, map[string]bool{}, &first)
+}
+
+func (j *Jsonnetizer) bundleKustomization(root string, w io.Writer, seen map[string]bool, first *bool) error {
+	kust, kustName, err := findKustFile(root)
+	if err != nil {
+		return err
+	}
+	data, err := readOutputFile(j, j.QualifyOutput(root, kustName))
+	if err != nil {
+		return err
+	}
+	var kustomization kustomizationFile
+	err = yaml.Unmarshal(data, &kustomization)
+	if err != nil {
+		return fmt.Errorf("parsing the output of %s: %w", kust, err)
+	}
+
+	var paths []string
+	for _, list := range [][]string{kustomization.Resources, kustomization.Components, kustomization.Bases} {
+		paths = append(paths, list...)
+	}
+	for _, path := range paths {
+		if !isLocalFile(path) {
+			continue
+		}
+		output := j.QualifyOutput(root, path)
+		if seen[output] {
+			continue
+		}
+		seen[output] = true
+
+		// directories are kustomizations, replicated under the same name
+		if si, err := os.Stat(filepath.Join(root, path)); err == nil && si.IsDir() {
+			err = j.bundleKustomization(filepath.Join(root, path), w, seen, first)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := readOutputFile(j, output)
+		if err != nil {
+			return err
+		}
+		data = bytes.TrimPrefix(data, []byte("---\n"))
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		if !*first {
+			_, err = io.WriteString(w, "---\n")
+			if err != nil {
+				return err
+			}
+		}
+		*first = false
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			data = append(data, '\n')
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonnetizer_Bundle(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `resources:
+- a.jsonnet
+- base
+- plain.yml
+- https://example.com/remote.yml
+generators:
+- generator.yml
+patches:
+- path: patch.yml
+`)
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "plain.yml"), "---\nkind: Plain\n---\nkind: Plainer")
+	writeFile(t, filepath.Join(src, "generator.yml"), "kind: Generator\n")
+	writeFile(t, filepath.Join(src, "patch.yml"), "kind: Patch\n")
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- b.jsonnet\n")
+	writeFile(t, filepath.Join(src, "base", "b.jsonnet"), `{"kind": "B"}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	var bundle bytes.Buffer
+	assert.NoError(t, j.Bundle(src, &bundle))
+	assert.Equal(t, "kind: A\n---\nkind: B\n---\nkind: Plain\n---\nkind: Plainer\n", bundle.String())
+}
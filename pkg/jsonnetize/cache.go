@@ -0,0 +1,118 @@
+package jsonnetize
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cachedPath returns where the YAML output of evaluating file is cached, or ""
+// when caching is disabled. The name is a hash of everything the evaluation
+// depends on: the output format, the jsonnet binary and its arguments, any
+// PreExec command, the files of external variables, file itself, or with
+// PreExec, its output preExecOut, and every local file it transitively imports.
+func (j *Jsonnetizer) cachedPath(file string, preExecOut []byte) (string, error) {
+	if j.CacheDir == "" {
+		return "", nil
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", j.format(file))
+	for _, arg := range append(append([]string{j.jsonnetBinFor(file)}, j.jsonnetArgs(file)...), j.PreExec...) {
+		fmt.Fprintf(h, "%s\x00", arg)
+	}
+	for _, v := range append(append([]string{}, j.ExtStrFiles...), j.ExtCodeFiles...) {
+		_, err := hashFile(h, v[strings.Index(v, "=")+1:])
+		if err != nil {
+			return "", err
+		}
+	}
+	var err error
+	if len(j.PreExec) > 0 {
+		// jsonnet evaluates what PreExec made of file, whatever file holds
+		hashSource(h, file, preExecOut)
+		err = hashImportsOf(j, h, file, preExecOut, map[string]bool{})
+	} else {
+		err = hashImports(j, h, file, map[string]bool{})
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(j.CacheDir, hex.EncodeToString(h.Sum(nil))+".yml"), nil
+}
+
+// hashImports writes file and everything it imports to h, each import
+// preceded by its resolved path so that moving a file changes the hash.
+func hashImports(j *Jsonnetizer, h hash.Hash, file string, seen map[string]bool) error {
+	src, err := hashFile(h, file)
+	if err != nil {
+		return err
+	}
+	return hashImportsOf(j, h, file, src, seen)
+}
+
+// hashImportsOf writes everything src, the source of file, imports to h.
+func hashImportsOf(j *Jsonnetizer, h hash.Hash, file string, src []byte, seen map[string]bool) error {
+	for _, imp := range scanImports(src) {
+		if !isLocalFile(imp.Path) {
+			continue
+		}
+		resolved, ok := j.resolveImport(file, imp.Path)
+		if !ok {
+			// creating the missing file later must change the hash
+			fmt.Fprintf(h, "unresolved\x00%s\x00", imp.Path)
+			continue
+		}
+		if seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+
+		var err error
+		if imp.Kind == "import" {
+			err = hashImports(j, h, resolved, seen)
+		} else {
+			_, err = hashFile(h, resolved)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashFile writes file's path and contents to h, returning the contents.
+func hashFile(h hash.Hash, file string) ([]byte, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	hashSource(h, file, src)
+	return src, nil
+}
+
+// hashSource writes file's path and src, its contents, to h.
+func hashSource(h hash.Hash, file string, src []byte) {
+	fmt.Fprintf(h, "%s\x00%d\x00", file, len(src))
+	h.Write(src)
+}
+
+// storeCached writes out to the cache at path. The cache is on the OS
+// filesystem whatever FS the output goes to, and is written atomically so
+// that concurrent runs never see a partial entry.
+func storeCached(path string, out []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), defaultDirMode)
+	if err != nil {
+		return err
+	}
+	return OSFS{}.WriteFile(path, 0644, func(w io.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
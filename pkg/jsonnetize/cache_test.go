@@ -0,0 +1,98 @@
+package jsonnetize
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessFileRef_Cache(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `import "lib.libsonnet"`)
+	writeFile(t, filepath.Join(src, "lib.libsonnet"), `{"kind": "A"}`)
+
+	cacheDir := t.TempDir()
+	process := func() string {
+		j := Jsonnetizer{Base: src, Output: t.TempDir(), CacheDir: cacheDir}
+		_, err := processFileRef(context.Background(), &j, src, "a.jsonnet")
+		assert.NoError(t, err)
+		out, err := ioutil.ReadFile(j.QualifyOutput(src, "a.jsonnet.yml"))
+		assert.NoError(t, err)
+		return string(out)
+	}
+
+	// the fake jsonnet echoes its input rather than evaluating imports
+	assert.Equal(t, "import \"lib.libsonnet\"\n", process())
+	assert.Len(t, invocations(), 1)
+
+	// hit
+	assert.Equal(t, "import \"lib.libsonnet\"\n", process())
+	assert.Len(t, invocations(), 1)
+
+	// a changed import misses
+	writeFile(t, filepath.Join(src, "lib.libsonnet"), `{"kind": "B"}`)
+	process()
+	assert.Len(t, invocations(), 2)
+
+	// as do changed arguments
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), CacheDir: cacheDir, ExtStrs: []string{"env=prod"}}
+	_, err := processFileRef(context.Background(), &j, src, "a.jsonnet")
+	assert.NoError(t, err)
+	assert.Len(t, invocations(), 3)
+
+	// and changed variable files
+	for _, content := range []string{"one", "one", "two"} {
+		writeFile(t, filepath.Join(src, "cert.pem"), content)
+		j = Jsonnetizer{Base: src, Output: t.TempDir(), CacheDir: cacheDir, ExtStrFiles: []string{"cert=" + filepath.Join(src, "cert.pem")}}
+		_, err = processFileRef(context.Background(), &j, src, "a.jsonnet")
+		assert.NoError(t, err)
+	}
+	assert.Len(t, invocations(), 5)
+}
+
+func TestProcessFileRef_NoCache(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{}`)
+
+	for i := 0; i < 2; i++ {
+		j := Jsonnetizer{Base: src, Output: t.TempDir()}
+		_, err := processFileRef(context.Background(), &j, src, "a.jsonnet")
+		assert.NoError(t, err)
+	}
+	assert.Len(t, invocations(), 2)
+}
+
+func TestProcessFileRef_CachePreExec(t *testing.T) {
+	_, invocations := fakeBin(t, "jsonnet", `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKE_JSONNET_LOG"
+cat
+`)
+	fakeBin(t, "subst", `#!/bin/sh
+sed "s/VAL/$VAL/"
+`)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"v": "VAL"}`)
+
+	cacheDir := t.TempDir()
+	process := func(val string) string {
+		setenv(t, "VAL", val)
+		j := Jsonnetizer{Base: src, Output: t.TempDir(), CacheDir: cacheDir, PreExec: []string{"subst"}}
+		_, err := processFileRef(context.Background(), &j, src, "a.jsonnet")
+		assert.NoError(t, err)
+		out, err := ioutil.ReadFile(j.QualifyOutput(src, "a.jsonnet.yml"))
+		assert.NoError(t, err)
+		return string(out)
+	}
+
+	// the cache is keyed on what the command makes of the file
+	assert.Equal(t, "v: one\n", process("one"))
+	assert.Equal(t, "v: one\n", process("one"))
+	assert.Len(t, invocations(), 1)
+	assert.Equal(t, "v: two\n", process("two"))
+	assert.Len(t, invocations(), 2)
+}
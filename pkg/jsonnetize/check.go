@@ -0,0 +1,141 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Difference is a file of the output tree on disk which isn't what a Run
+// would write.
+type Difference struct {
+	Path string
+	// Want is what a Run would write, nil for a file it wouldn't write at all.
+	Want []byte
+	// Got is what's written, nil for a file that's missing.
+	Got []byte
+}
+
+// Diff describes the difference line by line, lines only on disk prefixed
+// with - and those only a Run would write with +.
+func (d Difference) Diff() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s (written)\n+++ %s (generated)\n", d.Path, d.Path)
+	for _, line := range diffLines(splitLines(d.Got), splitLines(d.Want)) {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Check runs the pipeline for the kustomization at root in memory, comparing
+// what it would write with the output tree already on disk, which is left as
+// it is. It returns every file which is missing, different, or which a Run
+// wouldn't write, sorted by path; none means the output is up to date.
+func (j *Jsonnetizer) Check(ctx context.Context, root string) ([]Difference, error) {
+	if j.DryRun {
+		return nil, &ConfigError{fmt.Errorf("a dry run can't be checked")}
+	}
+	memFS := &MemFS{}
+	outputFS := j.FS
+	j.FS = memFS
+	defer func() { j.FS = outputFS }()
+	err := j.Run(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var differences []Difference
+	generated := map[string]bool{}
+	for _, name := range memFS.Files() {
+		generated[name] = true
+		want, _ := memFS.ReadFile(name)
+		got, err := ioutil.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err != nil || !bytes.Equal(want, got) {
+			differences = append(differences, Difference{Path: name, Want: want, Got: got})
+		}
+	}
+
+	// anything else in the output, as Clean would remove, is stale
+	dir := filepath.Clean(j.QualifyOutput(root, ""))
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && !generated[path] {
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			differences = append(differences, Difference{Path: path, Got: got})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(differences, func(a, b int) bool { return differences[a].Path < differences[b].Path })
+	return differences, nil
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// diffLines returns the lines of a and b in order, those only in a prefixed
+// with - and those only in b with +, keeping the longest common subsequence
+// of lines unprefixed.
+func diffLines(a, b []string) []string {
+	// lcs[i][k] is the length of the longest common subsequence of a[i:]
+	// and b[k:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for k := len(b) - 1; k >= 0; k-- {
+			switch {
+			case a[i] == b[k]:
+				lcs[i][k] = lcs[i+1][k+1] + 1
+			case lcs[i+1][k] >= lcs[i][k+1]:
+				lcs[i][k] = lcs[i+1][k]
+			default:
+				lcs[i][k] = lcs[i][k+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, k := 0, 0
+	for i < len(a) || k < len(b) {
+		switch {
+		case i < len(a) && k < len(b) && a[i] == b[k]:
+			lines = append(lines, " "+a[i])
+			i++
+			k++
+		case k == len(b) || (i < len(a) && lcs[i+1][k] >= lcs[i][k+1]):
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[k])
+			k++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,64 @@
+package jsonnetize
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonnetizer_Check(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n- b.jsonnet\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "b.jsonnet"), `{"kind": "B"}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+
+	// nothing written yet
+	differences, err := j.Check(context.Background(), src)
+	assert.NoError(t, err)
+	assert.Len(t, differences, 3)
+	_, err = os.Stat(j.QualifyOutput(src, "kustomization.yml"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, j.Run(context.Background(), src))
+	differences, err = j.Check(context.Background(), src)
+	assert.NoError(t, err)
+	assert.Empty(t, differences)
+
+	// out of sync: one changed, one missing and one stale
+	writeFile(t, j.QualifyOutput(src, "a.jsonnet.yml"), "kind: Old\n")
+	assert.NoError(t, os.Remove(j.QualifyOutput(src, "b.jsonnet.yml")))
+	writeFile(t, j.QualifyOutput(src, "stale.yml"), "kind: Stale\n")
+
+	differences, err = j.Check(context.Background(), src)
+	assert.NoError(t, err)
+	assert.Equal(t, []Difference{
+		{Path: j.QualifyOutput(src, "a.jsonnet.yml"), Want: []byte("kind: A\n"), Got: []byte("kind: Old\n")},
+		{Path: j.QualifyOutput(src, "b.jsonnet.yml"), Want: []byte("kind: B\n")},
+		{Path: j.QualifyOutput(src, "stale.yml"), Got: []byte("kind: Stale\n")},
+	}, differences)
+
+	// and the output is left alone
+	out, err := ioutil.ReadFile(j.QualifyOutput(src, "a.jsonnet.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: Old\n", string(out))
+	assert.Nil(t, j.FS)
+}
+
+func TestDifference_Diff(t *testing.T) {
+	d := Difference{Path: "out/a.yml", Got: []byte("kind: A\nname: old\nreplicas: 1\n"), Want: []byte("kind: A\nname: new\nreplicas: 1\nextra: true\n")}
+	assert.Equal(t, `--- out/a.yml (written)
++++ out/a.yml (generated)
+ kind: A
+-name: old
++name: new
+ replicas: 1
++extra: true
+`, d.Diff())
+}
@@ -0,0 +1,78 @@
+package jsonnetize
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic locates what jsonnet reported making it fail on a file, for
+// tools such as editors to point at.
+type Diagnostic struct {
+	// File is the file the error is in, which may be one the file jsonnet
+	// was run on imports.
+	File string `json:"file"`
+	// Line and Column are 1-based, or 0 when jsonnet didn't say.
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// diagnosticLocationPattern matches the location jsonnet starts static errors
+// and stack frames with, as file:line:column with an optional range after,
+// e.g. main.jsonnet:3:5-12 or main.jsonnet:(3:5)-(4:1).
+var diagnosticLocationPattern = regexp.MustCompile(`^(\S+?):\(?(\d+):(\d+)\)?(?:-\(?\d+(?::\d+)?\)?)?:?\s*`)
+
+// Diagnostic parses jsonnet's stderr into where and why it failed. Static
+// errors give their location before the message, runtime errors in the
+// first frame of the stack trace after it; without either, only File is
+// known.
+func (e *JsonnetError) Diagnostic() Diagnostic {
+	d := Diagnostic{File: e.File, Message: e.Err.Error()}
+	lines := strings.Split(e.Stderr, "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) == "" {
+		return d
+	}
+
+	first := lines[0]
+	for _, kind := range []string{"STATIC ERROR: ", "RUNTIME ERROR: "} {
+		first = strings.TrimPrefix(first, kind)
+	}
+	if match := diagnosticLocationPattern.FindStringSubmatch(first); match != nil {
+		d.File, d.Line, d.Column = match[1], atoi(match[2]), atoi(match[3])
+		d.Message = first[len(match[0]):]
+		return d
+	}
+	d.Message = first
+	for _, line := range lines[1:] {
+		if match := diagnosticLocationPattern.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			d.File, d.Line, d.Column = match[1], atoi(match[2]), atoi(match[3])
+			break
+		}
+	}
+	return d
+}
+
+// Diagnostics returns those of every JsonnetError err holds, including each
+// of Errors, in order; none if jsonnet didn't fail.
+func Diagnostics(err error) []Diagnostic {
+	var errs Errors
+	if errors.As(err, &errs) {
+		var diagnostics []Diagnostic
+		for _, err := range errs {
+			diagnostics = append(diagnostics, Diagnostics(err)...)
+		}
+		return diagnostics
+	}
+	var jsonnetErr *JsonnetError
+	if errors.As(err, &jsonnetErr) {
+		return []Diagnostic{jsonnetErr.Diagnostic()}
+	}
+	return nil
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
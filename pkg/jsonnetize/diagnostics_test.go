@@ -0,0 +1,60 @@
+package jsonnetize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonnetError_Diagnostic(t *testing.T) {
+	exit := errors.New("exit status 1")
+	for stderr, expected := range map[string]Diagnostic{
+		// go-jsonnet
+		"RUNTIME ERROR: boom\n\t/src/lib.libsonnet:3:9-26\tfunction <anonymous>\n\t/src/main.jsonnet:1:1-30\t$\n\tDuring evaluation\t": {File: "/src/lib.libsonnet", Line: 3, Column: 9, Message: "boom"},
+		"/src/main.jsonnet:2:5-6 Unexpected: \"}\" while parsing field definition":                                                     {File: "/src/main.jsonnet", Line: 2, Column: 5, Message: `Unexpected: "}" while parsing field definition`},
+		"RUNTIME ERROR: Field does not exist: foo\n\t/src/main.jsonnet:(1:1)-(3:2)\tobject <anonymous>":                                {File: "/src/main.jsonnet", Line: 1, Column: 1, Message: "Field does not exist: foo"},
+		// C++ jsonnet
+		"STATIC ERROR: /src/main.jsonnet:2:5: unexpected: \"}\" while parsing field definition": {File: "/src/main.jsonnet", Line: 2, Column: 5, Message: `unexpected: "}" while parsing field definition`},
+		// nothing to locate it by
+		"":              {File: "/src/main.jsonnet", Message: "exit status 1"},
+		"out of memory": {File: "/src/main.jsonnet", Message: "out of memory"},
+	} {
+		err := &JsonnetError{File: "/src/main.jsonnet", Stderr: stderr, Err: exit}
+		assert.Equal(t, expected, err.Diagnostic(), stderr)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	a := &JsonnetError{File: "a.jsonnet", Stderr: "RUNTIME ERROR: a\n\ta.jsonnet:1:2\t$", Err: errors.New("exit status 1")}
+	b := &JsonnetError{File: "b.jsonnet", Stderr: "b.jsonnet:3:4 b", Err: errors.New("exit status 1")}
+	err := fmt.Errorf("overlay: %w", Errors{
+		fmt.Errorf("processing resource: %w", a),
+		errors.New("not jsonnet's"),
+		b,
+	})
+	assert.Equal(t, []Diagnostic{
+		{File: "a.jsonnet", Line: 1, Column: 2, Message: "a"},
+		{File: "b.jsonnet", Line: 3, Column: 4, Message: "b"},
+	}, Diagnostics(err))
+
+	assert.Nil(t, Diagnostics(errors.New("not jsonnet's")))
+	assert.Nil(t, Diagnostics(nil))
+}
+
+func TestProcessFileRef_Diagnostic(t *testing.T) {
+	fakeBin(t, "jsonnet", `#!/bin/sh
+for last; do :; done
+printf 'RUNTIME ERROR: deliberate\n\t%s:2:3-24\tobject <anonymous>\n\tDuring manifestation\t\n' "$last" >&2
+exit 1
+`)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "main.jsonnet"), "{\n  a: error 'deliberate',\n}\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	_, err := processFileRef(context.Background(), &j, src, "main.jsonnet")
+	assert.Equal(t, []Diagnostic{{File: filepath.Join(src, "main.jsonnet"), Line: 2, Column: 3, Message: "deliberate"}}, Diagnostics(err))
+}
@@ -0,0 +1,74 @@
+package jsonnetize
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// JsonnetError is returned when jsonnet fails to evaluate a file.
+type JsonnetError struct {
+	File string
+	// Stderr holds jsonnet's diagnostics.
+	Stderr string
+	Err    error
+}
+
+func (e *JsonnetError) Error() string {
+	return fmt.Sprintf("jsonnet failed on %s: %v\n%s", e.File, e.Err, e.Stderr)
+}
+
+func (e *JsonnetError) Unwrap() error {
+	return e.Err
+}
+
+// KustomizeError is returned when kustomize fails to build a kustomization.
+// What kustomize had to say about it has already been logged.
+type KustomizeError struct {
+	Root string
+	Err  error
+}
+
+func (e *KustomizeError) Error() string {
+	return fmt.Sprintf("kustomize build of %s failed: %v", e.Root, e.Err)
+}
+
+func (e *KustomizeError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is returned when the configuration can't be used, e.g. because
+// a binary can't be found or a flag's value is malformed.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// Errors is returned by a Run with KeepGoing, holding the failure of every
+// path which couldn't be processed.
+type Errors []error
+
+func (e Errors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d paths failed:\n%s", len(e), strings.Join(messages, "\n"))
+}
+
+// As finds the first of the errors matching target, as errors.As does.
+func (e Errors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FS is the filesystem the output tree is written to. Paths are the OS paths
+// QualifyOutput returns.
+type FS interface {
+	MkdirAll(dir string, perm os.FileMode) error
+	// WriteFile replaces name with perm and the contents write gives it,
+	// leaving it as it was should write fail.
+	WriteFile(name string, perm os.FileMode, write func(w io.Writer) error) error
+	Open(name string) (io.ReadCloser, error)
+	RemoveAll(path string) error
+}
+
+// OSFS is the FS of the operating system, and the default one.
+type OSFS struct{}
+
+func (OSFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+// WriteFile writes to a temporary file in the same directory, renamed into
+// place once complete, so that a killed run never leaves name partially
+// written. Should name already hold the same contents with perm, it's left
+// alone instead, keeping its modification time for whatever goes by it.
+func (OSFS) WriteFile(name string, perm os.FileMode, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp-")
+	if err != nil {
+		return err
+	}
+	// fails harmlessly once the file is renamed
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if err == nil {
+		// TempFile creates files only their owner can read
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if sameFile(tmp.Name(), name, perm) {
+		return nil
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// sameFile reports whether the regular file dest has perm and the contents of
+// src, which it's about to be replaced with.
+func sameFile(src, dest string, perm os.FileMode) bool {
+	destInfo, err := os.Lstat(dest)
+	if err != nil || !destInfo.Mode().IsRegular() || destInfo.Mode().Perm() != perm {
+		return false
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil || srcInfo.Size() != destInfo.Size() {
+		return false
+	}
+	srcData, err := ioutil.ReadFile(src)
+	if err != nil {
+		return false
+	}
+	destData, err := ioutil.ReadFile(dest)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(srcData, destData)
+}
+
+func (OSFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (OSFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// defaultDirMode is the permissions directories are created with unless
+// DirMode gives others.
+const defaultDirMode os.FileMode = 0755
+
+func (j *Jsonnetizer) dirMode() os.FileMode {
+	if j.DirMode == 0 {
+		return defaultDirMode
+	}
+	return j.DirMode.Perm()
+}
+
+// ParseDirMode returns the permissions written in octal in s, e.g. 0750.
+func ParseDirMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, &ConfigError{fmt.Errorf("bad directory mode %q; must be octal permissions such as 0755", s)}
+	}
+	return os.FileMode(mode), nil
+}
+
+func (j *Jsonnetizer) fs() FS {
+	if j.FS == nil {
+		return OSFS{}
+	}
+	return j.FS
+}
+
+// readOutputFile reads back a file of the output tree.
+func readOutputFile(j *Jsonnetizer, name string) ([]byte, error) {
+	f, err := j.fs().Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writeOutputFile writes data to dest in the output tree, with the line
+// endings of text written as LineEnding has them.
+func writeOutputFile(j *Jsonnetizer, dest string, data []byte) error {
+	data = normalizeLineEndings(data, j.lineEnding())
+	return writeAtomic(j, dest, 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// copyFile copies src to dest in the output tree, with the line endings of
+// text written as lineEnding has them.
+func copyFile(j *Jsonnetizer, src, dest string, lineEnding LineEnding) error {
+	open, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer open.Close()
+
+	si, err := open.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(j, dest, si.Mode().Perm(), func(w io.Writer) error {
+		if lineEnding == LineEndingKeep {
+			_, err := io.Copy(w, open)
+			return err
+		}
+		data, err := ioutil.ReadAll(open)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(normalizeLineEndings(data, lineEnding))
+		return err
+	})
+}
+
+// writeAtomic creates dest in the output tree, along with its directory, with
+// perm and the contents write gives it. On the OS filesystem a killed run
+// never leaves dest partially written.
+func writeAtomic(j *Jsonnetizer, dest string, perm os.FileMode, write func(w io.Writer) error) error {
+	err := j.mkdirAll(filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	return j.fs().WriteFile(dest, perm, write)
+}
+
+// copyTree copies every regular file under root/path into the output tree,
+// but for those ignored. Symlinks to files are copied as the files they point
+// to; symlinks to directories aren't followed.
+func copyTree(j *Jsonnetizer, root, path string) error {
+	patterns, err := j.ignorePatterns(root)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(root, path)
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		if file != dir {
+			ignored, err := isIgnored(patterns, rel, d.IsDir())
+			if err != nil {
+				return err
+			}
+			if ignored && d.IsDir() {
+				return filepath.SkipDir
+			} else if ignored {
+				return nil
+			}
+		}
+		regular := d.Type().IsRegular()
+		if d.Type()&fs.ModeSymlink != 0 {
+			regular = isRegularFile(file)
+		}
+		if !regular {
+			return nil
+		}
+		return copyFileRef(j, root, rel)
+	})
+}
+
+// cleanOutput removes dir, the output root of a run, before anything is
+// written to it. It refuses to remove the filesystem root, the home or
+// working directory or any directory containing them, or any directory
+// containing the kustomization source at src.
+func cleanOutput(dir, src string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Lstat(abs); os.IsNotExist(err) {
+		return nil
+	}
+	abs, err = filepath.EvalSymlinks(abs)
+	if err != nil {
+		return err
+	}
+
+	protected := []string{src}
+	if cwd, err := os.Getwd(); err == nil {
+		protected = append(protected, cwd)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		protected = append(protected, home)
+	}
+	for _, p := range protected {
+		p, err = filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			p = resolved
+		}
+		if rel, err := filepath.Rel(abs, p); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("refusing to clean %s: it contains %s", abs, p)
+		}
+	}
+	if filepath.Dir(abs) == abs {
+		return fmt.Errorf("refusing to clean %s", abs)
+	}
+
+	return os.RemoveAll(abs)
+}
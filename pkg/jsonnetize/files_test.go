@@ -0,0 +1,146 @@
+package jsonnetize
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyFile_Perms(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+
+	for name, mode := range map[string]os.FileMode{"private": 0600, "script.sh": 0755} {
+		writeFile(t, filepath.Join(src, name), "content")
+		assert.NoError(t, os.Chmod(filepath.Join(src, name), mode))
+
+		assert.NoError(t, copyFile(&Jsonnetizer{}, filepath.Join(src, name), filepath.Join(dest, name), LineEndingLF))
+
+		si, err := os.Stat(filepath.Join(dest, name))
+		assert.NoError(t, err)
+		assert.Equal(t, mode, si.Mode().Perm(), name)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "kustomization.yml")
+	writeFile(t, dest, "old\n")
+
+	// a failed write leaves the old file untouched and nothing behind
+	err := writeAtomic(&Jsonnetizer{}, dest, 0644, func(w io.Writer) error {
+		_, _ = w.Write([]byte("partial"))
+		return errors.New("killed")
+	})
+	assert.EqualError(t, err, "killed")
+	content, err := ioutil.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "old\n", string(content))
+
+	assert.NoError(t, writeOutputFile(&Jsonnetizer{}, dest, []byte("new\n")))
+	content, err = ioutil.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "new\n", string(content))
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files should be cleaned up")
+}
+
+func TestJsonnetizer_Run_Unchanged(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n- b.jsonnet\n- c.yml\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "b.jsonnet"), `{"kind": "B"}`)
+	writeFile(t, filepath.Join(src, "c.yml"), "kind: C\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	// back-date the output rather than waiting for the clock to move
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	outputs := []string{"kustomization.yml", "a.jsonnet.yml", "b.jsonnet.yml", "c.yml"}
+	for _, output := range outputs {
+		assert.NoError(t, os.Chtimes(j.QualifyOutput(src, output), old, old))
+	}
+
+	writeFile(t, filepath.Join(src, "b.jsonnet"), `{"kind": "Changed"}`)
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	for _, output := range outputs {
+		si, err := os.Stat(j.QualifyOutput(src, output))
+		assert.NoError(t, err)
+		assert.Equal(t, output != "b.jsonnet.yml", si.ModTime().Equal(old), output)
+	}
+	content, err := ioutil.ReadFile(j.QualifyOutput(src, "b.jsonnet.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: Changed\n", string(content))
+
+	// a change of permissions alone is still written
+	assert.NoError(t, os.Chmod(filepath.Join(src, "c.yml"), 0600))
+	assert.NoError(t, j.Run(context.Background(), src))
+	si, err := os.Stat(j.QualifyOutput(src, "c.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), si.Mode().Perm())
+}
+
+func TestWriteOutputFile_DirMode(t *testing.T) {
+	out := t.TempDir()
+
+	// never more than 0755, whatever the umask
+	assert.NoError(t, writeOutputFile(&Jsonnetizer{}, filepath.Join(out, "default", "a.yml"), []byte("kind: A\n")))
+	si, err := os.Stat(filepath.Join(out, "default"))
+	assert.NoError(t, err)
+	assert.Zero(t, si.Mode().Perm()&^0755, "%v", si.Mode())
+
+	assert.NoError(t, writeOutputFile(&Jsonnetizer{DirMode: 0700}, filepath.Join(out, "private", "nested", "a.yml"), []byte("kind: A\n")))
+	for _, dir := range []string{"private", "private/nested"} {
+		si, err = os.Stat(filepath.Join(out, dir))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), si.Mode().Perm(), dir)
+	}
+}
+
+func TestParseDirMode(t *testing.T) {
+	mode, err := ParseDirMode("0750")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), mode)
+	mode, err = ParseDirMode("755")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), mode)
+
+	for _, bad := range []string{"", "0", "rwxr-xr-x", "0999", "01777"} {
+		_, err = ParseDirMode(bad)
+		var configErr *ConfigError
+		assert.True(t, errors.As(err, &configErr), bad)
+	}
+}
+
+func TestCleanOutput(t *testing.T) {
+	src := t.TempDir()
+	out := t.TempDir()
+	writeFile(t, filepath.Join(out, "stale.yml"), `{}`)
+
+	assert.NoError(t, cleanOutput(out, src))
+	_, err := os.Stat(out)
+	assert.True(t, os.IsNotExist(err))
+
+	// nothing to clean is fine
+	assert.NoError(t, cleanOutput(out, src))
+
+	cwd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.Error(t, cleanOutput(cwd, src))
+	assert.Error(t, cleanOutput(filepath.Dir(cwd), src))
+	assert.Error(t, cleanOutput("/", src))
+	assert.Error(t, cleanOutput(src, filepath.Join(src, "overlay")))
+	assert.DirExists(t, src)
+}
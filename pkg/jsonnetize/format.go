@@ -0,0 +1,97 @@
+package jsonnetize
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Format is the form jsonnet output is written in.
+type Format string
+
+const (
+	// FormatYAML converts each file's output to a YAML document.
+	FormatYAML Format = "yaml"
+	// FormatJSON writes jsonnet's JSON output as it is.
+	FormatJSON Format = "json"
+	// FormatYAMLStream evaluates each file to an array, written as a stream
+	// of YAML documents.
+	FormatYAMLStream Format = "yaml-stream"
+)
+
+var formats = []Format{FormatYAML, FormatJSON, FormatYAMLStream}
+
+// ParseFormat returns the Format named s.
+func ParseFormat(s string) (Format, error) {
+	for _, format := range formats {
+		if string(format) == s {
+			return format, nil
+		}
+	}
+
+	var names []string
+	for _, format := range formats {
+		names = append(names, string(format))
+	}
+	return "", &ConfigError{fmt.Errorf("unknown format %q; must be one of %s", s, strings.Join(names, ", "))}
+}
+
+// namedFormat returns the Format the name of the jsonnet file at path asks
+// for by the extension before .jsonnet, as foo.json.jsonnet asks for JSON and
+// foo.yaml.jsonnet for YAML, along with that extension. ok is false for names
+// which ask for none.
+func namedFormat(path string) (format Format, ext string, ok bool) {
+	if !strings.HasSuffix(path, ".jsonnet") {
+		return "", "", false
+	}
+	ext = filepath.Ext(strings.TrimSuffix(path, ".jsonnet"))
+	switch ext {
+	case ".json":
+		return FormatJSON, ext, true
+	case ".yaml", ".yml":
+		return FormatYAML, ext, true
+	}
+	return "", "", false
+}
+
+// format is the form the output of the jsonnet file at path is written in:
+// the one its name asks for, if any, or Format.
+func (j *Jsonnetizer) format(path string) Format {
+	if format, _, ok := namedFormat(path); ok {
+		return format
+	}
+	if j.Format == "" {
+		return FormatYAML
+	}
+	return j.Format
+}
+
+// outputExt is the extension given to the output of the jsonnet file at path:
+// the one its name asks for its format by, if any, or OutputExt.
+func (j *Jsonnetizer) outputExt(path string) string {
+	if _, ext, ok := namedFormat(path); ok {
+		return ext
+	}
+	if j.OutputExt != "" {
+		if !strings.HasPrefix(j.OutputExt, ".") {
+			return "." + j.OutputExt
+		}
+		return j.OutputExt
+	}
+	if j.format(path) == FormatJSON {
+		return ".json"
+	}
+	return ".yml"
+}
+
+// convertOutput converts what jsonnet printed for the file at path into its
+// output format.
+func (j *Jsonnetizer) convertOutput(path string, out []byte) ([]byte, error) {
+	switch j.format(path) {
+	case FormatJSON:
+		return out, nil
+	case FormatYAMLStream:
+		return yamlStreamToYAML(out)
+	}
+	return jsonToYAML(out)
+}
@@ -0,0 +1,126 @@
+package jsonnetize
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("yaml-stream")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatYAMLStream, format)
+
+	_, err = ParseFormat("toml")
+	assert.EqualError(t, err, `unknown format "toml"; must be one of yaml, json, yaml-stream`)
+}
+
+func TestProcessKustomization_Formats(t *testing.T) {
+	for format, expected := range map[Format]struct {
+		path, out string
+	}{
+		FormatYAML: {"a.jsonnet.yml", "kind: A\n"},
+		FormatJSON: {"a.jsonnet.json", `{"kind": "A"}`},
+	} {
+		fakeJsonnet(t)
+		src := t.TempDir()
+		writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n")
+		writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+
+		j := Jsonnetizer{Base: src, Output: t.TempDir(), Format: format}
+		assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+		assert.Equal(t, []string{expected.path}, readKustomization(t, j.QualifyOutput(src, "kustomization.yml")).Resources, format)
+		out, err := ioutil.ReadFile(j.QualifyOutput(src, expected.path))
+		assert.NoError(t, err)
+		assert.Equal(t, expected.out, string(out), format)
+	}
+}
+
+func TestProcessKustomization_OutputExt(t *testing.T) {
+	for _, test := range []struct {
+		format   Format
+		ext      string
+		expected string
+	}{
+		{FormatYAML, ".yaml", "a.jsonnet.yaml"},
+		{FormatYAML, "yaml", "a.jsonnet.yaml"},
+		{FormatJSON, ".json", "a.jsonnet.json"},
+		{FormatJSON, "", "a.jsonnet.json"},
+		{FormatYAML, "", "a.jsonnet.yml"},
+	} {
+		fakeJsonnet(t)
+		src := t.TempDir()
+		writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n")
+		writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+
+		j := Jsonnetizer{Base: src, Output: t.TempDir(), Format: test.format, OutputExt: test.ext}
+		assert.NoError(t, j.Run(context.Background(), src))
+
+		assert.Equal(t, []string{test.expected}, readKustomization(t, j.QualifyOutput(src, "kustomization.yml")).Resources, test.ext)
+		assert.FileExists(t, j.QualifyOutput(src, test.expected))
+	}
+
+	// stripped names take the extension too
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), OutputExt: ".yaml", StripJsonnetExt: true}
+	updated, err := processFileRef(context.Background(), &j, src, "a.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.yaml", updated)
+}
+
+func TestProcessKustomization_NamedFormats(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		format          Format
+		ext             string
+		stripJsonnetExt bool
+		path, out       string
+	}{
+		// the name wins over both the format and extension
+		{"a.json.jsonnet", FormatYAML, ".out", false, "a.json.jsonnet.json", `{"kind": "A"}`},
+		{"a.yaml.jsonnet", FormatJSON, ".out", false, "a.yaml.jsonnet.yaml", "kind: A\n"},
+		{"a.yml.jsonnet", FormatYAMLStream, "", false, "a.yml.jsonnet.yml", "kind: A\n"},
+		{"a.json.jsonnet", FormatYAML, "", true, "a.json", `{"kind": "A"}`},
+		{"a.yaml.jsonnet", FormatJSON, "", true, "a.yaml", "kind: A\n"},
+		// anything else takes the global ones
+		{"a.jsonnet", FormatJSON, "", false, "a.jsonnet.json", `{"kind": "A"}`},
+		{"a.txt.jsonnet", FormatYAML, ".out", false, "a.txt.jsonnet.out", "kind: A\n"},
+		{"a.txt.jsonnet", FormatYAML, "", true, "a.txt.yml", "kind: A\n"},
+	} {
+		fakeJsonnet(t)
+		src := t.TempDir()
+		writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- "+test.name+"\n")
+		writeFile(t, filepath.Join(src, test.name), `{"kind": "A"}`)
+
+		j := Jsonnetizer{Base: src, Output: t.TempDir(), Format: test.format, OutputExt: test.ext, StripJsonnetExt: test.stripJsonnetExt}
+		assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""), test.name)
+
+		assert.Equal(t, []string{test.path}, readKustomization(t, j.QualifyOutput(src, "kustomization.yml")).Resources, test.name)
+		out, err := ioutil.ReadFile(j.QualifyOutput(src, test.path))
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.out, string(out), test.name)
+	}
+}
+
+func TestProcessFileRef_YAMLStream(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	// what jsonnet -y prints for an array of two objects
+	writeFile(t, filepath.Join(src, "list.jsonnet"), "---\n{\"kind\": \"A\"}\n---\n{\"kind\": \"B\"}\n...\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Format: FormatYAMLStream, Multi: true}
+	updated, err := processMultiFileRef(context.Background(), &j, src, "list.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"list.jsonnet.yml"}, updated)
+
+	assert.Equal(t, []string{"--yaml-stream " + filepath.Join(src, "list.jsonnet")}, invocations())
+	out, err := ioutil.ReadFile(j.QualifyOutput(src, "list.jsonnet.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: A\n---\nkind: B\n", string(out))
+}
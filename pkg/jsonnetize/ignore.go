@@ -0,0 +1,61 @@
+package jsonnetize
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreName is the file in a kustomization root listing patterns, one per
+// line, of files and directories its directory copies skip, as Ignore does.
+// Blank lines and those starting with # are skipped.
+const ignoreName = ".jsonnetizeignore"
+
+// ignorePatterns returns the patterns directory copies under root skip: those
+// of Ignore and of the ignore file in root, if it has one.
+func (j *Jsonnetizer) ignorePatterns(root string) ([]string, error) {
+	patterns := append([]string{ignoreName}, j.Ignore...)
+	data, err := ioutil.ReadFile(filepath.Join(root, ignoreName))
+	if os.IsNotExist(err) {
+		return patterns, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// isIgnored reports whether rel, relative to its kustomization root, matches
+// one of patterns, either as a whole or by its name alone. Patterns ending in
+// a slash only match directories.
+func isIgnored(patterns []string, rel string, dir bool) (bool, error) {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if !dir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		for _, name := range []string{rel, filepath.Base(rel)} {
+			match, err := filepath.Match(pattern, name)
+			if err != nil {
+				return false, fmt.Errorf("bad ignore pattern %q: %w", pattern, err)
+			}
+			if match {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
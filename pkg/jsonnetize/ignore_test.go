@@ -0,0 +1,60 @@
+package jsonnetize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessSource_Ignore(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, ".jsonnetizeignore"), "# build artifacts\n*.log\n\nbuild/\n")
+	writeFile(t, filepath.Join(src, "data", "a.yml"), "kind: A\n")
+	writeFile(t, filepath.Join(src, "data", "debug.log"), "noise\n")
+	writeFile(t, filepath.Join(src, "data", "node_modules", "lib", "index.js"), "")
+	writeFile(t, filepath.Join(src, "data", "build", "out.yml"), "")
+	writeFile(t, filepath.Join(src, "data", "build.yml"), "kind: Build\n")
+	writeFile(t, filepath.Join(src, "data", ".git", "HEAD"), "")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Ignore: []string{"node_modules", "data/.git"}}
+	updated, err := processSource(context.Background(), &j, src, "data")
+	assert.NoError(t, err)
+	assert.Equal(t, "data", updated)
+
+	assert.FileExists(t, j.QualifyOutput(src, "data/a.yml"))
+	assert.FileExists(t, j.QualifyOutput(src, "data/build.yml"), "only directories match build/")
+	for _, ignored := range []string{"data/debug.log", "data/node_modules", "data/build", "data/.git"} {
+		_, err = os.Stat(j.QualifyOutput(src, ignored))
+		assert.True(t, os.IsNotExist(err), ignored)
+	}
+
+	j.Ignore = []string{"["}
+	_, err = processSource(context.Background(), &j, src, "data")
+	assert.EqualError(t, err, `bad ignore pattern "[": syntax error in pattern`)
+}
+
+func TestIsIgnored(t *testing.T) {
+	patterns := []string{".jsonnetizeignore", "*.log", "vendor/", "docs/*.md"}
+	for rel, ignored := range map[string]bool{
+		"app.log":           true,
+		"logs/app.log":      true,
+		"vendor":            true,
+		"lib/vendor":        true,
+		"docs/README.md":    true,
+		"README.md":         false,
+		"src/docs/guide.md": false,
+		"app.yml":           false,
+		".jsonnetizeignore": true,
+	} {
+		match, err := isIgnored(patterns, rel, rel == "vendor" || rel == "lib/vendor")
+		assert.NoError(t, err)
+		assert.Equal(t, ignored, match, rel)
+	}
+
+	match, err := isIgnored(patterns, "vendor", false)
+	assert.NoError(t, err)
+	assert.False(t, match, "vendor/ only matches directories")
+}
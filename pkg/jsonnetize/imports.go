@@ -0,0 +1,390 @@
+package jsonnetize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type jsonnetImport struct {
+	// Kind is one of import, importstr or importbin.
+	Kind string
+	Path string
+}
+
+// scanImports finds the imports in jsonnet source, skipping over comments and
+// string literals. Only imports of literal paths are found, which is all the
+// jsonnet language allows.
+func scanImports(src []byte) []jsonnetImport {
+	var imports []jsonnetImport
+	s := string(src)
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == '#' || strings.HasPrefix(s[i:], "//") || strings.HasPrefix(s[i:], "/*"):
+			i = skipComment(s, i)
+		case c == '"' || c == '\'' || strings.HasPrefix(s[i:], "@\"") || strings.HasPrefix(s[i:], "@'") || strings.HasPrefix(s[i:], "|||"):
+			_, i = readString(s, i)
+		case isIdentStart(c):
+			start := i
+			for i < len(s) && isIdentPart(s[i]) {
+				i++
+			}
+			kind := s[start:i]
+			if kind != "import" && kind != "importstr" && kind != "importbin" {
+				continue
+			}
+			i = skipSpace(s, i)
+			if i < len(s) && (s[i] == '"' || s[i] == '\'' || s[i] == '@') {
+				var path string
+				path, i = readString(s, i)
+				imports = append(imports, jsonnetImport{Kind: kind, Path: path})
+			}
+		default:
+			i++
+		}
+	}
+	return imports
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// skipComment returns the index just past the comment starting at i.
+func skipComment(s string, i int) int {
+	if strings.HasPrefix(s[i:], "/*") {
+		end := strings.Index(s[i+2:], "*/")
+		if end < 0 {
+			return len(s)
+		}
+		return i + 2 + end + 2
+	}
+	end := strings.IndexByte(s[i:], '\n')
+	if end < 0 {
+		return len(s)
+	}
+	return i + end + 1
+}
+
+// skipSpace returns the index of the first character at or after i that is
+// neither whitespace nor part of a comment.
+func skipSpace(s string, i int) int {
+	for i < len(s) {
+		switch {
+		case s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r':
+			i++
+		case s[i] == '#' || strings.HasPrefix(s[i:], "//") || strings.HasPrefix(s[i:], "/*"):
+			i = skipComment(s, i)
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// readString decodes the string literal starting at i, returning its value
+// and the index just past it.
+func readString(s string, i int) (string, int) {
+	switch {
+	case strings.HasPrefix(s[i:], "|||"):
+		end := strings.Index(s[i+3:], "|||")
+		if end < 0 {
+			return "", len(s)
+		}
+		return s[i+3 : i+3+end], i + 3 + end + 3
+	case s[i] == '@':
+		// verbatim strings escape their quote by doubling it
+		if i+1 >= len(s) {
+			return "", len(s)
+		}
+		quote := s[i+1]
+		var value strings.Builder
+		for i += 2; i < len(s); i++ {
+			if s[i] == quote {
+				if i+1 < len(s) && s[i+1] == quote {
+					value.WriteByte(quote)
+					i++
+					continue
+				}
+				return value.String(), i + 1
+			}
+			value.WriteByte(s[i])
+		}
+		return value.String(), len(s)
+	}
+
+	quote := s[i]
+	var value strings.Builder
+	for i++; i < len(s); i++ {
+		switch s[i] {
+		case quote:
+			return value.String(), i + 1
+		case '\\':
+			i++
+			if i >= len(s) {
+				return value.String(), len(s)
+			}
+			switch s[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'r':
+				value.WriteByte('\r')
+			case 'b':
+				value.WriteByte('\b')
+			case 'f':
+				value.WriteByte('\f')
+			case 'u':
+				if i+4 < len(s) {
+					if r, err := strconv.ParseUint(s[i+1:i+5], 16, 32); err == nil {
+						value.WriteRune(rune(r))
+						i += 4
+						continue
+					}
+				}
+				value.WriteByte(s[i])
+			default:
+				value.WriteByte(s[i])
+			}
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return value.String(), len(s)
+}
+
+// resolveImport finds the file an import of path from within file refers to.
+// Like jsonnet, it looks beside the importing file first and then through the
+// jpaths, right-most first.
+func (j *Jsonnetizer) resolveImport(file, path string) (string, bool) {
+	resolved, _, ok := j.resolveImportDir(file, path)
+	return resolved, ok
+}
+
+// resolveImportDir behaves like resolveImport, also returning the directory
+// searched which the import was found in.
+func (j *Jsonnetizer) resolveImportDir(file, path string) (string, string, bool) {
+	if filepath.IsAbs(path) {
+		return path, filepath.Dir(path), isRegularFile(path)
+	}
+
+	dirs := []string{filepath.Dir(file)}
+	for i := len(j.JPaths) - 1; i >= 0; i-- {
+		dirs = append(dirs, j.JPaths[i])
+	}
+	for _, dir := range dirs {
+		if candidate := filepath.Join(dir, path); isRegularFile(candidate) {
+			return candidate, dir, true
+		}
+	}
+	return "", "", false
+}
+
+func isRegularFile(path string) bool {
+	si, err := os.Stat(path)
+	return err == nil && si.Mode().IsRegular()
+}
+
+// unchangedSince reports whether Since is set, output has been written, and
+// neither file nor anything it transitively imports has been modified since.
+func (j *Jsonnetizer) unchangedSince(file, output string) (bool, error) {
+	if j.Since.IsZero() {
+		return false, nil
+	}
+	f, err := j.fs().Open(output)
+	if err != nil {
+		// written or not, it'll be compiled
+		return false, nil
+	}
+	f.Close()
+	changed, err := j.changedSince(file, map[string]bool{})
+	return !changed, err
+}
+
+// changedSince reports whether file, or anything it transitively imports,
+// has been modified since Since. An import which can't be found counts as a
+// change, for jsonnet to report.
+func (j *Jsonnetizer) changedSince(file string, seen map[string]bool) (bool, error) {
+	si, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	if !si.ModTime().Before(j.Since) {
+		return true, nil
+	}
+	if !isJsonnetFile(file) && !isLibsonnetFile(file) {
+		return false, nil
+	}
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	for _, imp := range scanImports(src) {
+		if !isLocalFile(imp.Path) {
+			continue
+		}
+		resolved, ok := j.resolveImport(file, imp.Path)
+		if !ok {
+			return true, nil
+		}
+		if seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+		changed, err := j.changedSince(resolved, seen)
+		if err != nil || changed {
+			return changed, err
+		}
+	}
+	return false, nil
+}
+
+// copyImports copies every local file that file transitively imports into the
+// output tree, mirroring its location, so the tree stays self-contained.
+// Files imported with importstr or importbin are copied byte-for-byte, and
+// not scanned for imports of their own.
+func copyImports(j *Jsonnetizer, root, file string) error {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	for _, imp := range scanImports(src) {
+		if !isLocalFile(imp.Path) {
+			j.logger().Debugf("%s imports %s, which is not a local file; leaving it alone", file, imp.Path)
+			continue
+		}
+		resolved, ok := j.resolveImport(file, imp.Path)
+		if !ok {
+			// jsonnet reports unresolvable imports far better than we can
+			continue
+		}
+		if !j.markCopied(resolved) {
+			continue
+		}
+
+		lineEnding := j.lineEnding()
+		if imp.Kind != "import" {
+			// jsonnet reads assets as they are, whatever the output's line endings
+			lineEnding = LineEndingKeep
+		}
+		j.report(ReportEntry{Root: root, Source: resolved, Output: j.QualifyOutput(resolved, ""), Action: ReportCopied})
+		err = copyToOutput(j, resolved, j.QualifyOutput(resolved, ""), lineEnding)
+		if err != nil {
+			return err
+		}
+		if imp.Kind == "import" {
+			err = copyImports(j, root, resolved)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// traceImports logs where every import of file, and of the files it imports
+// in turn, resolves to, searching as jsonnet does. seen holds the files
+// already traced.
+func (j *Jsonnetizer) traceImports(file string, seen map[string]bool) {
+	if seen[file] {
+		return
+	}
+	seen[file] = true
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	for _, imp := range scanImports(src) {
+		if !isLocalFile(imp.Path) {
+			j.logger().Printf("trace: %s: %s %q is not a local file", file, imp.Kind, imp.Path)
+			continue
+		}
+		resolved, dir, ok := j.resolveImportDir(file, imp.Path)
+		if !ok {
+			j.logger().Printf("trace: %s: %s %q not found beside it or in any jpath", file, imp.Kind, imp.Path)
+			continue
+		}
+		j.logger().Printf("trace: %s: %s %q -> %s (found in %s)", file, imp.Kind, imp.Path, resolved, dir)
+		if imp.Kind == "import" {
+			j.traceImports(resolved, seen)
+		}
+	}
+}
+
+// checkImports returns an error should file, or any file it imports in turn,
+// import an absolute path or one resolving outside root and the jpaths, when
+// RestrictImports is set. jsonnet only imports literal paths, so none are
+// missed. Symlinks are followed, and imports which don't resolve are left for
+// jsonnet to report.
+func (j *Jsonnetizer) checkImports(root, file string) error {
+	if !j.RestrictImports {
+		return nil
+	}
+	allowed := []string{root}
+	allowed = append(allowed, j.JPaths...)
+	for i, dir := range allowed {
+		allowed[i] = realPath(dir)
+	}
+	return j.checkImportsWithin(allowed, file, map[string]bool{})
+}
+
+func (j *Jsonnetizer) checkImportsWithin(allowed []string, file string, seen map[string]bool) error {
+	if seen[file] {
+		return nil
+	}
+	seen[file] = true
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	for _, imp := range scanImports(src) {
+		if filepath.IsAbs(imp.Path) {
+			return fmt.Errorf("%s: %s %q is absolute, which restricted imports don't allow", file, imp.Kind, imp.Path)
+		}
+		resolved, _, ok := j.resolveImportDir(file, imp.Path)
+		if !ok {
+			continue
+		}
+		if !isWithinAny(allowed, realPath(resolved)) {
+			return fmt.Errorf("%s: %s %q resolves to %s, outside the kustomization root and jpaths", file, imp.Kind, imp.Path, resolved)
+		}
+		if imp.Kind == "import" {
+			err = j.checkImportsWithin(allowed, resolved, seen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// realPath returns path made absolute with its symlinks resolved, as far as
+// either can be.
+func realPath(path string) string {
+	path = absPath(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+func isWithinAny(dirs []string, path string) bool {
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
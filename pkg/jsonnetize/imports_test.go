@@ -0,0 +1,139 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanImports(t *testing.T) {
+	src := `
+// import "commented.libsonnet"
+# import "hashed.libsonnet"
+/* import "block.libsonnet" */
+local a = import 'a.libsonnet';
+local b = import "dir/b.jsonnet";
+local s = "import \"not-an-import.libsonnet\"";
+{
+  text: importstr @"files/config.txt",
+  data: importbin "files/data.bin",
+  spaced: import /* inline */ "spaced.libsonnet",
+  importer: "value",
+}
+`
+	assert.Equal(t, []jsonnetImport{
+		{Kind: "import", Path: "a.libsonnet"},
+		{Kind: "import", Path: "dir/b.jsonnet"},
+		{Kind: "importstr", Path: "files/config.txt"},
+		{Kind: "importbin", Path: "files/data.bin"},
+		{Kind: "import", Path: "spaced.libsonnet"},
+	}, scanImports([]byte(src)))
+}
+
+func TestCopyImports(t *testing.T) {
+	src := t.TempDir()
+	vendor := t.TempDir()
+	writeFile(t, filepath.Join(src, "main.jsonnet"), `(import "lib/a.libsonnet") + (import "k.libsonnet") + {c: importstr "config.txt"}`)
+	writeFile(t, filepath.Join(src, "lib", "a.libsonnet"), `import "b.libsonnet"`)
+	writeFile(t, filepath.Join(src, "lib", "b.libsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "config.txt"), `import "not-followed.libsonnet"`)
+	writeFile(t, filepath.Join(src, "unused.libsonnet"), `{}`)
+	writeFile(t, filepath.Join(vendor, "k.libsonnet"), `import "https://example.com/remote.libsonnet"`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), JPaths: []string{vendor}}
+	assert.NoError(t, copyImports(&j, src, filepath.Join(src, "main.jsonnet")))
+
+	for _, path := range []string{
+		filepath.Join(src, "lib", "a.libsonnet"),
+		filepath.Join(src, "lib", "b.libsonnet"),
+		filepath.Join(src, "config.txt"),
+		filepath.Join(vendor, "k.libsonnet"),
+	} {
+		assert.FileExists(t, j.QualifyOutput(path, ""))
+	}
+	_, err := ioutil.ReadFile(j.QualifyOutput(src, "unused.libsonnet"))
+	assert.Error(t, err)
+}
+
+func TestJsonnetizer_Run_ImportedAssets(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- main.jsonnet\n")
+	writeFile(t, filepath.Join(src, "main.jsonnet"), `{data: {text: importstr "files/config.txt", raw: std.base64(importbin "files/data.bin")}}`)
+	writeFile(t, filepath.Join(src, "files", "config.txt"), "key = value\r\n")
+	binary := []byte{0x00, 0xff, '\r', '\n', 0x1b, 0x80}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "files", "data.bin"), binary, 0644))
+
+	// even with the output's line endings normalized to the default LF
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	// assets are copied as they are, line endings and all
+	text, err := ioutil.ReadFile(j.QualifyOutput(src, "files/config.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "key = value\r\n", string(text))
+	data, err := ioutil.ReadFile(j.QualifyOutput(src, "files/data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, binary, data)
+}
+
+func TestEvaluateJsonnet_Trace(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	vendor := t.TempDir()
+	writeFile(t, filepath.Join(src, "main.jsonnet"), `(import "k.libsonnet") + {missing: import "missing.libsonnet"}`)
+	writeFile(t, filepath.Join(vendor, "k.libsonnet"), `{kind: importstr "kind.txt"}`)
+	writeFile(t, filepath.Join(vendor, "kind.txt"), `A`)
+
+	var log bytes.Buffer
+	j := Jsonnetizer{JPaths: []string{vendor}, Log: NewLogger(&log, false)}
+	_, err := j.evaluateJsonnet(context.Background(), filepath.Join(src, "main.jsonnet"))
+	assert.NoError(t, err)
+	assert.Empty(t, log.String())
+
+	j.Trace = true
+	_, err = j.evaluateJsonnet(context.Background(), filepath.Join(src, "main.jsonnet"))
+	assert.NoError(t, err)
+	for _, line := range []string{
+		fmt.Sprintf(`trace: %s: import "k.libsonnet" -> %s (found in %s)`, filepath.Join(src, "main.jsonnet"), filepath.Join(vendor, "k.libsonnet"), vendor),
+		fmt.Sprintf(`trace: %s: import "missing.libsonnet" not found beside it or in any jpath`, filepath.Join(src, "main.jsonnet")),
+		fmt.Sprintf(`trace: %s: importstr "kind.txt" -> %s (found in %s)`, filepath.Join(vendor, "k.libsonnet"), filepath.Join(vendor, "kind.txt"), vendor),
+	} {
+		assert.Contains(t, log.String(), line)
+	}
+}
+
+func TestProcessFileRef_RestrictImports(t *testing.T) {
+	fakeJsonnet(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	vendor := t.TempDir()
+	writeFile(t, filepath.Join(src, "ok.jsonnet"), `(import "lib/a.libsonnet") + (import "k.libsonnet")`)
+	writeFile(t, filepath.Join(src, "lib", "a.libsonnet"), `{}`)
+	writeFile(t, filepath.Join(vendor, "k.libsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "passwd.jsonnet"), `{users: importstr "/etc/passwd"}`)
+	writeFile(t, filepath.Join(src, "escape.jsonnet"), `import "lib/escape.libsonnet"`)
+	writeFile(t, filepath.Join(src, "lib", "escape.libsonnet"), `import "../../secret.libsonnet"`)
+	writeFile(t, filepath.Join(dir, "secret.libsonnet"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), JPaths: []string{vendor}, RestrictImports: true}
+	_, err := processFileRef(context.Background(), &j, src, "ok.jsonnet")
+	assert.NoError(t, err)
+
+	_, err = processFileRef(context.Background(), &j, src, "passwd.jsonnet")
+	assert.EqualError(t, err, filepath.Join(src, "passwd.jsonnet")+`: importstr "/etc/passwd" is absolute, which restricted imports don't allow`)
+
+	// found through an import of an import
+	_, err = processFileRef(context.Background(), &j, src, "escape.jsonnet")
+	assert.EqualError(t, err, fmt.Sprintf(`%s: import "../../secret.libsonnet" resolves to %s, outside the kustomization root and jpaths`,
+		filepath.Join(src, "lib", "escape.libsonnet"), filepath.Join(dir, "secret.libsonnet")))
+
+	j = Jsonnetizer{Base: src, Output: t.TempDir(), JPaths: []string{vendor}}
+	_, err = processFileRef(context.Background(), &j, src, "escape.jsonnet")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,485 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func (j *Jsonnetizer) jsonnetArgs(input string) []string {
+	var args []string
+	for _, jpath := range j.JPaths {
+		args = append(args, "-J", absPath(jpath))
+	}
+	vars := j.varsFor(input)
+	for _, extStr := range vars.ExtStrs {
+		args = append(args, "--ext-str", extStr)
+	}
+	if j.RootExtStr != "" {
+		args = append(args, "--ext-str", j.RootExtStr+"="+j.kustomizationRoot(input))
+	}
+	for _, extCode := range vars.ExtCodes {
+		args = append(args, "--ext-code", extCode)
+	}
+	for _, extStrFile := range j.ExtStrFiles {
+		args = append(args, "--ext-str-file", extStrFile)
+	}
+	for _, extCodeFile := range j.ExtCodeFiles {
+		args = append(args, "--ext-code-file", extCodeFile)
+	}
+	for _, tlaStr := range vars.TLAStrs {
+		args = append(args, "--tla-str", tlaStr)
+	}
+	for _, tlaCode := range vars.TLACodes {
+		args = append(args, "--tla-code", tlaCode)
+	}
+	if j.format(input) == FormatYAMLStream {
+		args = append(args, "--yaml-stream")
+	}
+	return append(args, absPath(input))
+}
+
+// kustomizationRoot returns the resolved root of the innermost kustomization
+// processed which file is under, or file's directory if there's none.
+func (j *Jsonnetizer) kustomizationRoot(file string) string {
+	dir := filepath.Dir(absPath(file))
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	innermost := ""
+	for _, root := range j.visitedRoots() {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(root) > len(innermost) {
+			innermost = root
+		}
+	}
+	if innermost == "" {
+		return dir
+	}
+	return innermost
+}
+
+// absPath returns path made absolute, as jsonnet runs from another directory,
+// or path itself if it can't be.
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+// jsonnetWarningPattern matches the lines jsonnet writes to stderr without
+// failing: those of std.trace, and warnings such as deprecation notices.
+var jsonnetWarningPattern = regexp.MustCompile(`(?m)^(TRACE: \S+:\d+ |(?i:warning): )`)
+
+// preExecFileVar is the environment variable giving PreExec the path of the
+// file it's run on.
+const preExecFileVar = "JSONNETIZE_FILE"
+
+// preExec returns the contents of the jsonnet file at path as PreExec
+// rewrites them.
+func (j *Jsonnetizer) preExec(ctx context.Context, path string) ([]byte, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j.logger().Debugf("Running %s on %s", strings.Join(j.PreExec, " "), path)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, j.PreExec[0], j.PreExec[1:]...)
+	cmd.Dir = filepath.Dir(absPath(path))
+	cmd.Env = append(os.Environ(), preExecFileVar+"="+absPath(path))
+	cmd.Stdin = bytes.NewReader(src)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		if stderr.Len() > 0 {
+			err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil, fmt.Errorf("pre-exec %s on %s: %w", j.PreExec[0], path, err)
+	}
+	return out, nil
+}
+
+// evaluateJsonnet runs jsonnet on path and returns what it wrote to stdout.
+// With PreExec, jsonnet reads what it makes of path from stdin instead.
+func (j *Jsonnetizer) evaluateJsonnet(ctx context.Context, path string) ([]byte, error) {
+	var preExecOut []byte
+	if len(j.PreExec) > 0 {
+		var err error
+		preExecOut, err = j.preExec(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return j.evaluatePreExecuted(ctx, path, preExecOut)
+}
+
+// evaluatePreExecuted is evaluateJsonnet given preExecOut, what PreExec
+// already made of path, if set. Should jsonnet fail, the error carries its
+// diagnostics; otherwise anything it wrote to stderr is logged as a warning,
+// or with FailOnWarning, returned as an error if it looks like one.
+func (j *Jsonnetizer) evaluatePreExecuted(ctx context.Context, path string, preExecOut []byte) ([]byte, error) {
+	j.logger().Debugf("Running jsonnet on %s", path)
+	if j.Trace {
+		j.traceImports(path, map[string]bool{})
+	}
+
+	bin := j.jsonnetBinFor(path)
+	if filepath.Base(bin) != bin {
+		bin = absPath(bin)
+	}
+	args := j.jsonnetArgs(path)
+	if len(j.PreExec) > 0 {
+		args[len(args)-1] = "-"
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	// run from the file's own directory, as anything it reads relative to the
+	// working directory expects, imports from stdin included
+	cmd.Dir = filepath.Dir(absPath(path))
+	cmd.Stdin = bytes.NewReader(preExecOut)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		// the process was killed; its exit status says nothing useful
+		return nil, ctx.Err()
+	}
+	if len(j.PreExec) > 0 {
+		// for diagnostics to locate errors in the file
+		named := bytes.ReplaceAll(stderr.Bytes(), []byte("<stdin>"), []byte(path))
+		stderr.Reset()
+		stderr.Write(named)
+	}
+	if err != nil {
+		return nil, &JsonnetError{File: path, Stderr: string(bytes.TrimSpace(stderr.Bytes())), Err: err}
+	}
+	if j.FailOnWarning && jsonnetWarningPattern.Match(stderr.Bytes()) {
+		return nil, &JsonnetError{File: path, Stderr: string(bytes.TrimSpace(stderr.Bytes())), Err: fmt.Errorf("warnings from an otherwise successful evaluation")}
+	}
+	if stderr.Len() > 0 {
+		j.logger().Warnf("%s", stderr.Bytes())
+	}
+	return out, nil
+}
+
+func processFileRef(ctx context.Context, j *Jsonnetizer, root, path string) (string, error) {
+	qPath := filepath.Join(root, path)
+	compile, err := j.shouldCompile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !isLocalFile(path) {
+		j.logger().Debugf("%s is not a local file; leaving it alone", path)
+		j.report(ReportEntry{Root: root, Source: path, Action: ReportSkipped})
+		return path, nil
+	}
+	err = j.checkWithinRoot(root, path)
+	if err != nil {
+		return "", err
+	}
+
+	if isJsonnetFile(qPath) && !filepath.IsAbs(path) && compile {
+		err = j.checkImports(root, qPath)
+		if err != nil {
+			return "", err
+		}
+		updatedPath, err := j.outputName(root, path, j.outputExt(path))
+		if err != nil {
+			return "", err
+		}
+		cmd := append([]string{j.jsonnetBinFor(qPath)}, j.jsonnetArgs(qPath)...)
+		entry := ReportEntry{Root: root, Source: path, Output: j.QualifyOutput(root, updatedPath), Action: ReportCompiled, Command: cmd}
+		if j.DryRun {
+			j.recordAction("jsonnet", qPath, j.QualifyOutput(root, updatedPath), strings.Join(cmd, " "))
+			j.report(entry)
+			return updatedPath, copyImports(j, root, qPath)
+		}
+
+		err = j.processOnce(entry.Output+"\x00"+strings.Join(cmd, "\x00"), func() error {
+			return compileFileRef(ctx, j, qPath, &entry)
+		})
+		if err != nil {
+			return "", err
+		}
+		j.report(entry)
+		return updatedPath, copyImports(j, root, qPath)
+	}
+	// anything else is copied as it is, .libsonnet files included: libraries
+	// usually aren't valid programs on their own, so they're only ever
+	// copied for the files importing them
+	return path, copyFileRef(j, root, path)
+}
+
+// compileFileRef evaluates the jsonnet file at qPath, or takes its output from
+// the cache, writing it to entry.Output. Output already written is kept as it
+// is should neither the file nor its imports have changed since Since.
+func compileFileRef(ctx context.Context, j *Jsonnetizer, qPath string, entry *ReportEntry) error {
+	unchanged, err := j.unchangedSince(qPath, entry.Output)
+	if err != nil {
+		return err
+	}
+	if unchanged {
+		j.logger().Debugf("%s hasn't changed since %s; keeping %s", qPath, j.Since.Format(time.RFC3339), entry.Output)
+		entry.Unchanged = true
+		return nil
+	}
+
+	var preExecOut []byte
+	if len(j.PreExec) > 0 {
+		preExecOut, err = j.preExec(ctx, qPath)
+		if err != nil {
+			return err
+		}
+	}
+	cached, err := j.cachedPath(qPath, preExecOut)
+	if err != nil {
+		return err
+	}
+	if cached != "" && isRegularFile(cached) {
+		j.logger().Debugf("Using cached output of %s", qPath)
+		entry.Cached = true
+		return copyFile(j, cached, entry.Output, j.lineEnding())
+	}
+
+	out, err := j.evaluatePreExecuted(ctx, qPath, preExecOut)
+	if err != nil {
+		return err
+	}
+	out, err = j.convertOutput(qPath, out)
+	if err != nil {
+		return fmt.Errorf("couldn't convert jsonnet output of %s to %s: %w", qPath, j.format(qPath), err)
+	}
+
+	err = writeOutputFile(j, entry.Output, out)
+	if err != nil {
+		return err
+	}
+	if cached != "" {
+		err = storeCached(cached, out)
+		if err != nil {
+			// a broken cache only costs time
+			j.logger().Warnf("Couldn't cache the output of %s: %v", qPath, err)
+		}
+	}
+	return nil
+}
+
+// checkWithinRoot returns an error if root/path lies outside root, unless
+// AllowEscape is set. Paths are compared as written, so a symlink within root
+// may still lead outside it.
+func (j *Jsonnetizer) checkWithinRoot(root, path string) error {
+	if j.AllowEscape {
+		return nil
+	}
+	rel, err := filepath.Rel(root, filepath.Join(root, path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside the kustomization root %s", path, root)
+	}
+	return nil
+}
+
+// shouldCompile reports whether the jsonnet file at path, relative to its
+// kustomization root, is to be compiled under the Include and Exclude
+// patterns. Exclude wins when both match.
+func (j *Jsonnetizer) shouldCompile(path string) (bool, error) {
+	for _, pattern := range j.Exclude {
+		match, err := filepath.Match(pattern, path)
+		if err != nil {
+			return false, fmt.Errorf("bad exclude pattern %q: %w", pattern, err)
+		}
+		if match {
+			return false, nil
+		}
+	}
+	if len(j.Include) == 0 {
+		return true, nil
+	}
+	for _, pattern := range j.Include {
+		match, err := filepath.Match(pattern, path)
+		if err != nil {
+			return false, fmt.Errorf("bad include pattern %q: %w", pattern, err)
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// outputName returns the name the output of the jsonnet file at root/path is
+// written under: path with suffix appended, or in place of its extension if
+// StripJsonnetExt is set, along with any naming its format. A stripped name
+// mustn't collide with a source file, since that would have the output
+// replace it.
+func (j *Jsonnetizer) outputName(root, path, suffix string) (string, error) {
+	if !j.StripJsonnetExt {
+		return path + suffix, nil
+	}
+
+	name := strings.TrimSuffix(path, ".jsonnet")
+	if _, ext, ok := namedFormat(path); ok {
+		name = strings.TrimSuffix(name, ext)
+	}
+	name += suffix
+	if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+		return "", fmt.Errorf("output of %s would replace %s; rename one of them or don't strip the jsonnet extension", path, name)
+	}
+	return name, nil
+}
+
+func copyFileRef(j *Jsonnetizer, root, path string) error {
+	src, dest := filepath.Join(root, path), j.QualifyOutput(root, path)
+	j.report(ReportEntry{Root: root, Source: path, Output: dest, Action: ReportCopied})
+	return j.processOnce(src+"\x00"+dest, func() error {
+		return copyToOutput(j, src, dest, j.lineEnding())
+	})
+}
+
+func copyToOutput(j *Jsonnetizer, src, dest string, lineEnding LineEnding) error {
+	if j.DryRun {
+		j.recordAction("copy", src, dest)
+		return nil
+	}
+	return copyFile(j, src, dest, lineEnding)
+}
+
+// processMultiFileRef behaves like processFileRef, except that a jsonnet file
+// evaluating to an array is split into one numbered output per element.
+func processMultiFileRef(ctx context.Context, j *Jsonnetizer, root, path string) ([]string, error) {
+	qPath := filepath.Join(root, path)
+	compile, err := j.shouldCompile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// a dry run can't know how the output would be split, and a YAML stream
+	// already is
+	if j.DryRun || j.format(qPath) == FormatYAMLStream || !isLocalFile(path) || !isJsonnetFile(qPath) || filepath.IsAbs(path) || !compile {
+		updatedPath, err := processFileRef(ctx, j, root, path)
+		if err != nil {
+			return nil, err
+		}
+		return []string{updatedPath}, nil
+	}
+
+	err = j.checkImports(root, qPath)
+	if err != nil {
+		return nil, err
+	}
+	cmd := append([]string{j.jsonnetBinFor(qPath)}, j.jsonnetArgs(qPath)...)
+	out, err := j.evaluateJsonnet(ctx, qPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = copyImports(j, root, qPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(out), []byte("[")) {
+		out, err = j.convertOutput(qPath, out)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't convert jsonnet output of %s to %s: %w", qPath, j.format(qPath), err)
+		}
+		updatedPath, err := j.outputName(root, path, j.outputExt(path))
+		if err != nil {
+			return nil, err
+		}
+		j.report(ReportEntry{Root: root, Source: path, Output: j.QualifyOutput(root, updatedPath), Action: ReportCompiled, Command: cmd})
+		return []string{updatedPath}, writeOutputFile(j, j.QualifyOutput(root, updatedPath), out)
+	}
+
+	var docs []json.RawMessage
+	err = json.Unmarshal(out, &docs)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't split jsonnet output of %s: %w", qPath, err)
+	}
+
+	var updatedPaths []string
+	for i, doc := range docs {
+		updatedPath, err := j.outputName(root, path, fmt.Sprintf(".%d%s", i, j.outputExt(path)))
+		if err != nil {
+			return nil, err
+		}
+		doc, err = j.convertOutput(qPath, doc)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't convert jsonnet output of %s to %s: %w", qPath, j.format(qPath), err)
+		}
+		err = writeOutputFile(j, j.QualifyOutput(root, updatedPath), doc)
+		if err != nil {
+			return nil, err
+		}
+		j.report(ReportEntry{Root: root, Source: path, Output: j.QualifyOutput(root, updatedPath), Action: ReportCompiled, Command: cmd})
+		updatedPaths = append(updatedPaths, updatedPath)
+	}
+	return updatedPaths, nil
+}
+
+// remoteHosts are the hosts kustomize lets remote references name without a
+// scheme.
+var remoteHosts = []string{"github.com/", "gitlab.com/", "bitbucket.org/"}
+
+// windowsPathPattern matches Windows absolute paths, which would otherwise
+// parse as URLs with the drive letter as their scheme.
+var windowsPathPattern = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+
+// isLocalFile reports whether path refers to the local filesystem, as opposed
+// to a URL or one of kustomize's remote references such as
+// github.com/org/repo//overlay?ref=v1.
+func isLocalFile(path string) bool {
+	if windowsPathPattern.MatchString(path) {
+		return true
+	}
+	if strings.HasPrefix(path, "git@") || strings.HasPrefix(path, "git::") {
+		return false
+	}
+	for _, host := range remoteHosts {
+		if strings.HasPrefix(path, host) {
+			return false
+		}
+	}
+
+	parse, err := url.Parse(path)
+	if err != nil {
+		return false
+	}
+	if parse.Scheme == "file" {
+		return true
+	}
+	// kustomize separates a repository from the path within it with //
+	if parse.Scheme != "" || strings.Contains(path, "//") {
+		return false
+	}
+	return parse.Query().Get("ref") == "" && parse.Query().Get("version") == ""
+}
+
+// isJsonnetFile reports whether path is a jsonnet program to be evaluated.
+// Extensions are matched case-sensitively, as jsonnet tooling does.
+func isJsonnetFile(path string) bool {
+	return strings.HasSuffix(path, ".jsonnet") && len(filepath.Base(path)) > len(".jsonnet")
+}
+
+// isLibsonnetFile reports whether path is a jsonnet library, meant to be
+// imported rather than evaluated.
+func isLibsonnetFile(path string) bool {
+	return strings.HasSuffix(path, ".libsonnet") && len(filepath.Base(path)) > len(".libsonnet")
+}
@@ -0,0 +1,340 @@
+package jsonnetize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessFileRef_JPaths(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.jsonnet"), "{}")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), JPaths: []string{"/lib/a", "/lib/b"}}
+	updated, err := processFileRef(context.Background(), &j, src, "a.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.jsonnet.yml", updated)
+
+	calls := invocations()
+	if assert.Len(t, calls, 1) {
+		assert.Equal(t, "-J /lib/a -J /lib/b "+filepath.Join(src, "a.jsonnet"), calls[0])
+	}
+}
+
+func TestJsonnetizer_JsonnetArgs(t *testing.T) {
+	j := Jsonnetizer{
+		JPaths:   []string{"lib"},
+		ExtStrs:  []string{"env=prod"},
+		ExtCodes: []string{"replicas=3"},
+		TLAStrs:  []string{"name=foo"},
+		TLACodes: []string{"debug=true"},
+
+		ExtStrFiles:  []string{"cert=/certs/ca.pem"},
+		ExtCodeFiles: []string{"config=/etc/config.json"},
+	}
+
+	// jsonnet runs from the input's directory, so relative paths are made
+	// absolute
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"-J", filepath.Join(wd, "lib"),
+		"--ext-str", "env=prod",
+		"--ext-code", "replicas=3",
+		"--ext-str-file", "cert=/certs/ca.pem",
+		"--ext-code-file", "config=/etc/config.json",
+		"--tla-str", "name=foo",
+		"--tla-code", "debug=true",
+		filepath.Join(wd, "in.jsonnet"),
+	}, j.jsonnetArgs("in.jsonnet"))
+}
+
+func TestProcessFileRef_WorkingDir(t *testing.T) {
+	// a jsonnet which can only find the sibling from the file's directory
+	fakeBin(t, "jsonnet", `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKE_JSONNET_LOG"
+if [ ! -f ./sibling.libsonnet ]; then
+	echo "RUNTIME ERROR: couldn't open import ./sibling.libsonnet" >&2
+	exit 1
+fi
+cat ./sibling.libsonnet
+`)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "app", "main.jsonnet"), `import "./sibling.libsonnet"`)
+	writeFile(t, filepath.Join(src, "app", "sibling.libsonnet"), `{"kind": "A"}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	updated, err := processFileRef(context.Background(), &j, src, "app/main.jsonnet")
+	assert.NoError(t, err)
+	out, err := ioutil.ReadFile(j.QualifyOutput(src, updated))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: A\n", string(out))
+}
+
+func TestProcessFileRef_FailOnWarning(t *testing.T) {
+	// a jsonnet evaluating a std.trace call, as jsonnet reports it
+	fakeBin(t, "jsonnet", `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKE_JSONNET_LOG"
+echo "TRACE: main.jsonnet:1 rendering" >&2
+echo '{"kind": "A"}'
+`)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "main.jsonnet"), `std.trace("rendering", {kind: "A"})`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	updated, err := processFileRef(context.Background(), &j, src, "main.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "main.jsonnet.yml", updated)
+
+	j = Jsonnetizer{Base: src, Output: t.TempDir(), FailOnWarning: true}
+	_, err = processFileRef(context.Background(), &j, src, "main.jsonnet")
+	var jsonnetErr *JsonnetError
+	if assert.True(t, errors.As(err, &jsonnetErr), "%v", err) {
+		assert.Equal(t, "TRACE: main.jsonnet:1 rendering", jsonnetErr.Stderr)
+	}
+	_, err = os.Stat(j.QualifyOutput(src, "main.jsonnet.yml"))
+	assert.True(t, os.IsNotExist(err))
+
+	// stderr that isn't a warning is only logged
+	assert.False(t, jsonnetWarningPattern.MatchString("rendering main.jsonnet\n"))
+	assert.True(t, jsonnetWarningPattern.MatchString("WARNING: std.foo is deprecated\n"))
+}
+
+func TestJsonnetizer_Run_Since(t *testing.T) {
+	// evaluates a file by dropping its imports
+	_, invocations := fakeBin(t, "jsonnet", `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKE_JSONNET_LOG"
+for last; do :; done
+grep -v import "$last"
+`)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- old.jsonnet\n- new.jsonnet\n- imports.jsonnet\n- unwritten.jsonnet\n")
+	for _, name := range []string{"old", "new", "imports", "unwritten"} {
+		writeFile(t, filepath.Join(src, name+".jsonnet"), `{"kind": "Before"}`)
+	}
+	writeFile(t, filepath.Join(src, "lib.libsonnet"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), CacheDir: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+	assert.NoError(t, os.Remove(j.QualifyOutput(src, "unwritten.jsonnet.yml")))
+
+	// everything changes, but only some of it after the threshold
+	since := time.Now().Add(-time.Hour)
+	before, after := since.Add(-time.Minute), since.Add(time.Minute)
+	writeFile(t, filepath.Join(src, "imports.jsonnet"), "(import \"lib.libsonnet\") +\n{\"kind\": \"After\"}\n")
+	for name, modTime := range map[string]time.Time{
+		"old.jsonnet":       before,
+		"new.jsonnet":       after,
+		"imports.jsonnet":   before,
+		"lib.libsonnet":     after,
+		"unwritten.jsonnet": before,
+	} {
+		if name != "imports.jsonnet" && name != "lib.libsonnet" {
+			writeFile(t, filepath.Join(src, name), `{"kind": "After"}`)
+		}
+		assert.NoError(t, os.Chtimes(filepath.Join(src, name), modTime, modTime))
+	}
+
+	compiled := len(invocations())
+	j.Since = since
+	assert.NoError(t, j.Run(context.Background(), src))
+	assert.Len(t, invocations(), compiled+3, "only the unchanged file with output is kept")
+
+	for name, kind := range map[string]string{"old": "Before", "new": "After", "imports": "After", "unwritten": "After"} {
+		out, err := ioutil.ReadFile(j.QualifyOutput(src, name+".jsonnet.yml"))
+		assert.NoError(t, err)
+		assert.Contains(t, string(out), "kind: "+kind, name)
+	}
+	for _, entry := range j.Report() {
+		assert.Equal(t, entry.Source == "old.jsonnet", entry.Unchanged, entry.Source)
+	}
+}
+
+func TestProcessFileRef_TLAs(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "object.jsonnet"), `{"kind": "Namespace"}`)
+	writeFile(t, filepath.Join(src, "broken.jsonnet"), `{"kind": error "boom"}`)
+
+	out := t.TempDir()
+	j := Jsonnetizer{Base: src, Output: out, TLAStrs: []string{"name=foo"}}
+
+	// non-function files still evaluate with TLAs supplied
+	updated, err := processFileRef(context.Background(), &j, src, "object.jsonnet")
+	assert.NoError(t, err)
+	bytes, err := ioutil.ReadFile(j.QualifyOutput(src, updated))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: Namespace\n", string(bytes))
+
+	// and evaluation errors are surfaced rather than swallowed
+	_, err = processFileRef(context.Background(), &j, src, "broken.jsonnet")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "RUNTIME ERROR: "+filepath.Join(src, "broken.jsonnet"))
+	}
+}
+
+func TestIsJsonnetFile(t *testing.T) {
+	for _, tt := range []struct {
+		path      string
+		jsonnet   bool
+		libsonnet bool
+	}{
+		{"a.jsonnet", true, false},
+		{"dir/a.jsonnet", true, false},
+		{"a.libsonnet", false, true},
+		{"a.jsonnet.yml", false, false},
+		{"jsonnet", false, false},
+		{".jsonnet", false, false},
+		{"a.JSONNET", false, false},
+	} {
+		assert.Equal(t, tt.jsonnet, isJsonnetFile(tt.path), tt.path)
+		assert.Equal(t, tt.libsonnet, isLibsonnetFile(tt.path), tt.path)
+	}
+}
+
+func TestProcessFileRef_Libsonnet(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `(import "lib.libsonnet") + {}`)
+	writeFile(t, filepath.Join(src, "lib.libsonnet"), `{kind: "Namespace"}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	updated, err := processFileRef(context.Background(), &j, src, "a.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.jsonnet.yml", updated)
+
+	// the library is copied verbatim for the import to resolve, not evaluated
+	bytes, err := ioutil.ReadFile(j.QualifyOutput(src, "lib.libsonnet"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{kind: "Namespace"}`, string(bytes))
+	assert.Len(t, invocations(), 1)
+
+	updated, err = processFileRef(context.Background(), &j, src, "lib.libsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "lib.libsonnet", updated)
+	assert.Len(t, invocations(), 1)
+}
+
+func TestIsLocalFile(t *testing.T) {
+	for path, local := range map[string]bool{
+		"deployment.yml":                         true,
+		"../base":                                true,
+		"/abs/path.jsonnet":                      true,
+		"file:///abs/path.yml":                   true,
+		"https://example.com/deploy.yml":         false,
+		"github.com/org/repo//overlay?ref=v1":    false,
+		"github.com/org/repo/overlay":            false,
+		"git@github.com:org/repo.git//overlay":   false,
+		"git::https://example.com/org/repo.git":  false,
+		"example.com/org/repo?ref=main":          false,
+		"ssh://git@example.com/org/repo.git":     false,
+		"gitlab.com/org/repo//deploy?version=v2": false,
+		`C:\path\file.jsonnet`:                   true,
+		"C:/path/file.jsonnet":                   true,
+		`..\base\deployment.yml`:                 true,
+		`\\server\share\deployment.yml`:          true,
+	} {
+		assert.Equal(t, local, isLocalFile(path), path)
+	}
+}
+
+func TestJsonnetizer_ShouldCompile(t *testing.T) {
+	j := Jsonnetizer{
+		Include: []string{"apps/*.jsonnet", "*.jsonnet"},
+		Exclude: []string{"apps/experimental-*.jsonnet"},
+	}
+	for path, compile := range map[string]bool{
+		"top.jsonnet":                   true,
+		"apps/web.jsonnet":              true,
+		"apps/experimental-web.jsonnet": false,
+		"other/web.jsonnet":             false,
+	} {
+		actual, err := j.shouldCompile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, compile, actual, path)
+	}
+
+	// with no includes everything not excluded is compiled
+	j.Include = nil
+	compile, err := j.shouldCompile("other/web.jsonnet")
+	assert.NoError(t, err)
+	assert.True(t, compile)
+
+	j.Exclude = []string{"["}
+	_, err = j.shouldCompile("a.jsonnet")
+	assert.Error(t, err)
+}
+
+func TestProcessFileRef_Exclude(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "skip.jsonnet"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Exclude: []string{"skip.*"}}
+	updated, err := processFileRef(context.Background(), &j, src, "skip.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "skip.jsonnet", updated)
+	assert.FileExists(t, j.QualifyOutput(src, "skip.jsonnet"))
+	assert.Empty(t, invocations())
+}
+
+func TestJsonnetizer_RootExtStr(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	writeFile(t, filepath.Join(src, "app", "kustomization.yml"), "resources:\n- manifests/main.jsonnet\n")
+	writeFile(t, filepath.Join(src, "app", "manifests", "main.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "lib", "other.jsonnet"), `{"kind": "B"}`)
+
+	// the root of the kustomization a file is under, however deep
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), RootExtStr: "kustomizeRoot"}
+	assert.NoError(t, j.Run(context.Background(), filepath.Join(src, "app")))
+	assert.Equal(t, []string{"--ext-str kustomizeRoot=" + filepath.Join(src, "app") + " " + filepath.Join(src, "app", "manifests", "main.jsonnet")}, invocations())
+
+	// or with none, its directory
+	assert.Equal(t, filepath.Join(src, "lib"), (&Jsonnetizer{}).kustomizationRoot(filepath.Join(src, "lib", "other.jsonnet")))
+}
+
+func TestJsonnetizer_Run_PreExec(t *testing.T) {
+	_, jsonnetInvocations := fakeBin(t, "jsonnet", `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKE_JSONNET_LOG"
+for last; do :; done
+cat "$last"
+`)
+	_, preExecInvocations := fakeBin(t, "upcase", `#!/bin/sh
+printf '%s\n' "$JSONNETIZE_FILE" >> "$FAKE_UPCASE_LOG"
+sed 's/configmap/CONFIGMAP/'
+`)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- main.jsonnet\n- a.yml\n")
+	writeFile(t, filepath.Join(src, "main.jsonnet"), `{"kind": "configmap"}`)
+	writeFile(t, filepath.Join(src, "a.yml"), "kind: configmap\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), PreExec: []string{"upcase"}}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	data, err := ioutil.ReadFile(j.QualifyOutput(src, "main.jsonnet.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: CONFIGMAP\n", string(data))
+	// jsonnet reads the rewritten file from stdin
+	assert.Equal(t, []string{"-"}, jsonnetInvocations())
+
+	// copied files are left alone
+	data, err = ioutil.ReadFile(j.QualifyOutput(src, "a.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: configmap\n", string(data))
+	assert.Equal(t, []string{filepath.Join(src, "main.jsonnet")}, preExecInvocations())
+
+	// a failing command fails the file
+	j.PreExec = []string{"false"}
+	err = j.Run(context.Background(), src)
+	assert.EqualError(t, err, fmt.Sprintf(`processing resource "main.jsonnet" under %q: pre-exec false on %s: exit status 1`, src, filepath.Join(src, "main.jsonnet")))
+}
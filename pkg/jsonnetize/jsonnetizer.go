@@ -0,0 +1,583 @@
+// Package jsonnetize replicates a kustomization tree, evaluating the jsonnet
+// files it references into YAML that kustomize can build.
+package jsonnetize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+// Jsonnetizer replicates kustomization trees, compiling the jsonnet files
+// they refer to along the way. Its exported fields are its configuration.
+type Jsonnetizer struct {
+	Base     string   `yaml:"base"`
+	Output   string   `yaml:"output"`
+	JPaths   []string `yaml:"jpaths"`
+	ExtStrs  []string `yaml:"extStrs"`
+	ExtCodes []string `yaml:"extCodes"`
+	// RootExtStr, when set, names an external string variable each file is
+	// evaluated with, e.g. kustomizeRoot, holding the resolved root of the
+	// innermost kustomization processed which the file is under, or else
+	// the file's own directory. Shared libraries can read it with
+	// std.extVar to decide by location.
+	RootExtStr string `yaml:"rootExtStr"`
+	// ExtStrFiles and ExtCodeFiles are key=path pairs, jsonnet reading the
+	// value of each variable from its file.
+	ExtStrFiles  []string `yaml:"extStrFiles"`
+	ExtCodeFiles []string `yaml:"extCodeFiles"`
+	// TLAStrs and TLACodes are only bound when a file evaluates to a
+	// function; jsonnet ignores them for any other top-level value.
+	TLAStrs  []string `yaml:"tlaStrs"`
+	TLACodes []string `yaml:"tlaCodes"`
+	// JsonnetBin is the jsonnet binary to run; defaults to jsonnet.
+	JsonnetBin string `yaml:"jsonnetBin"`
+	// PreExec, when set, is a command each jsonnet file compiled is piped
+	// through before jsonnet evaluates its output in the file's place, e.g.
+	// envsubst. It's run from the file's directory, with JSONNETIZE_FILE
+	// holding the file's path. Files which are copied are left as they are.
+	PreExec []string `yaml:"preExec"`
+	// KustomizeCmd is the kustomize command to run, optionally including
+	// its subcommand; defaults to kustomize build.
+	KustomizeCmd []string `yaml:"kustomizeCmd"`
+	// AlphaPluginsFlag is passed to kustomize to enable alpha plugins;
+	// leave it empty to run without them.
+	AlphaPluginsFlag string `yaml:"alphaPluginsFlag"`
+	// KustomizeFlags are passed to kustomize build before the root. Each must
+	// be a flag, with any value in the same argument, e.g. --reorder=none.
+	KustomizeFlags []string `yaml:"kustomizeFlags"`
+	// KustomizeArgs, when set, replaces everything kustomize is run with
+	// after the command's binary: the subcommand, the flags above and the
+	// root. {{root}} in each is replaced by the root to build, which at least
+	// one must contain.
+	KustomizeArgs []string `yaml:"kustomizeArgs"`
+	// BuildOutput is the file kustomize build output is written to; empty
+	// means stdout.
+	BuildOutput string `yaml:"buildOutput"`
+	// Env holds environment variables to set for kustomize, on top of those
+	// of this process, e.g. KUSTOMIZE_PLUGIN_HOME for alpha plugins.
+	Env map[string]string `yaml:"env"`
+	// Retries is how many more times a kustomize build failing for other
+	// reasons than its input is attempted, with exponential backoff.
+	Retries int `yaml:"retries"`
+	// Jobs bounds how many paths of a single list are processed at once.
+	Jobs int `yaml:"jobs"`
+	// BuildConcurrency bounds how many kustomize builds BuildRoots runs at
+	// once, kustomize being far hungrier for memory than jsonnet; defaults
+	// to 1. Jobs doesn't apply to builds.
+	BuildConcurrency int `yaml:"buildConcurrency"`
+	// Include, when set, limits the jsonnet files compiled to those matching
+	// one of its patterns; those matching one of Exclude are never compiled.
+	// Either way, files which aren't compiled are copied as they are.
+	// Patterns are matched with filepath.Match against paths relative to
+	// their kustomization root.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// Ignore holds patterns of the files and directories skipped when a
+	// directory is copied, matched against both their paths relative to
+	// their kustomization root and their names; those ending in a slash only
+	// match directories. A .jsonnetizeignore file in the root adds its own.
+	Ignore []string `yaml:"ignore"`
+	// Format is the form jsonnet output is written in; defaults to
+	// FormatYAML. A file named for a format, as foo.json.jsonnet and
+	// foo.yaml.jsonnet are, is written in that one, with its extension.
+	Format Format `yaml:"format"`
+	// OutputExt is the extension given to the output of jsonnet files, with
+	// or without its leading dot; defaults to .json for FormatJSON and to
+	// .yml otherwise.
+	OutputExt string `yaml:"outputExt"`
+	// LineEnding is how the line endings of the text files written are
+	// normalized; defaults to LineEndingLF. Binary files are left alone.
+	LineEnding LineEnding `yaml:"lineEnding"`
+	// StripJsonnetExt names jsonnet output after the file with its .jsonnet
+	// extension replaced, rather than appended to.
+	StripJsonnetExt bool `yaml:"stripJsonnetExt"`
+	// Multi splits jsonnet resources and strategic merge patches evaluating
+	// to an array into one output file per element.
+	Multi bool `yaml:"multi"`
+	// Validate checks that every document jsonnet resources compile to has
+	// an apiVersion and kind, so mistakes are caught before kustomize
+	// reports them less clearly.
+	Validate bool `yaml:"validate"`
+	// KRM checks that jsonnet generators and transformers compile to the
+	// single ResourceList of the KRM function protocol, its items Kubernetes
+	// resources, as kustomize reads their config in that form.
+	KRM bool `yaml:"krm"`
+	// Inline embeds the output of compiled jsonnet patches in the
+	// kustomization, in place of their paths. kustomize has no inline form
+	// of resources, so they're always written to files. Experimental.
+	Inline bool `yaml:"inline"`
+	// CopySiblings copies the whole directory holding each plugin config
+	// file, so that the templates, schemas and other files a plugin reads
+	// beside its config are found. Everything in that directory is copied,
+	// which for a config beside its kustomization file is the whole root.
+	CopySiblings bool `yaml:"copySiblings"`
+	// KeepGoing processes every path it can, rather than stopping at the
+	// first failure. Failed paths are left as they were, and Run returns
+	// their errors together as Errors.
+	KeepGoing bool `yaml:"keepGoing"`
+	// AllowEscape lets kustomizations refer to files outside their root,
+	// relaxing kustomize's load restrictions to match. Like those, it
+	// doesn't apply to the other kustomizations referred to.
+	AllowEscape bool `yaml:"allowEscape"`
+	// RestrictImports refuses to evaluate jsonnet files importing absolute
+	// paths, or paths resolving outside their kustomization root and JPaths,
+	// for jsonnet which can't be trusted to read only what it should.
+	RestrictImports bool `yaml:"restrictImports"`
+	// Since, when set, keeps the output already written for jsonnet files
+	// which, like everything they import, were last modified before it,
+	// rather than compiling them again. Only modification times are
+	// compared, so changed arguments aren't noticed; files split by Multi
+	// are always compiled.
+	Since time.Time `yaml:"since"`
+	// CacheDir is where the YAML output of jsonnet files is cached, keyed by
+	// a hash of their contents, imports and arguments; empty disables the
+	// cache.
+	CacheDir string `yaml:"cacheDir"`
+	// FailOnWarning fails the evaluation of jsonnet files which write
+	// warnings, such as those of std.trace, even should jsonnet succeed.
+	FailOnWarning bool `yaml:"failOnWarning"`
+	// Trace logs where each import of the jsonnet files evaluated resolves
+	// to, searching beside the importing file and through JPaths as jsonnet
+	// does.
+	Trace bool `yaml:"trace"`
+	// Progress logs a running count of the paths of the kustomizations
+	// processed, out of those found so far.
+	Progress bool `yaml:"progress"`
+	// DryRun records the actions that would be taken instead of
+	// evaluating or writing anything.
+	DryRun bool `yaml:"dryRun"`
+	// DirMode is the permissions the directories of the output tree and
+	// build output are created with, before the umask; defaults to 0755.
+	DirMode os.FileMode `yaml:"dirMode"`
+	// FS is where the output tree is written; defaults to OSFS. kustomize
+	// can only build output on the OS filesystem.
+	FS FS `yaml:"-"`
+	// Log receives progress messages; defaults to stderr without debug
+	// messages.
+	Log *Logger `yaml:"-"`
+
+	mu      sync.Mutex
+	actions []string
+	copied  map[string]bool
+	// fileVars holds the sidecar arguments of jsonnet files by path
+	fileVars map[string]jsonnetVars
+	// rootBins holds the jsonnet binaries sidecars give, by absolute root
+	rootBins map[string]string
+	// visited holds the resolved roots of the kustomizations processed
+	visited map[string]bool
+	reports []ReportEntry
+	// trees holds the kustomizations processed, for Tree
+	trees map[[2]string]treeRecord
+	// processed holds the outcome of each file compiled or copied, keyed by
+	// what was done, so that files referred to repeatedly are only
+	// processed once
+	processed map[string]*outcome
+	// failures holds the errors of the paths KeepGoing went past
+	failures Errors
+	// done and total count the paths processed and found, for Progress
+	done, total int
+
+	// dirMu serializes the creation of output directories, which overlap
+	// between files processed concurrently; dirs holds those created
+	dirMu sync.Mutex
+	dirs  map[string]bool
+}
+
+// QualifyOutput returns where root/path is replicated to. The output tree
+// mirrors the tree under Base, so that Base/overlay/kustomization.yml is
+// written to Output/overlay/kustomization.yml. Anything outside Base, or
+// everything when Base is empty, is written under its full path instead.
+func (j *Jsonnetizer) QualifyOutput(root, path string) string {
+	if rel, ok := j.relativeToBase(filepath.Join(root, path)); ok {
+		return filepath.Join(j.Output, rel)
+	}
+
+	// a volume such as C: can't be nested under Output, so its letter
+	// stands in for it
+	volume := filepath.VolumeName(root)
+	root = root[len(volume):]
+	return filepath.Join(j.Output, strings.TrimSuffix(volume, ":"), root, path)
+}
+
+// relativeToBase returns path relative to Base, reporting false if it isn't
+// within Base.
+func (j *Jsonnetizer) relativeToBase(path string) (string, bool) {
+	if j.Base == "" {
+		return "", false
+	}
+	base, err := filepath.Abs(j.Base)
+	if err != nil {
+		return "", false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// recordAction notes an action skipped by a dry run as a tab-separated line.
+func (j *Jsonnetizer) recordAction(action string, fields ...string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.actions = append(j.actions, strings.Join(append([]string{action}, fields...), "\t"))
+}
+
+// Actions returns the recorded dry run actions, sorted so that they're
+// stable regardless of processing order.
+func (j *Jsonnetizer) Actions() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	actions := append([]string{}, j.actions...)
+	sort.Strings(actions)
+	return actions
+}
+
+// markCopied records that src has been copied, reporting false if it already
+// had been.
+func (j *Jsonnetizer) markCopied(src string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.copied[src] {
+		return false
+	}
+	if j.copied == nil {
+		j.copied = map[string]bool{}
+	}
+	j.copied[src] = true
+	return true
+}
+
+// keepGoing records err for Run to return, reporting whether processing is
+// to carry on past it. It never does once ctx is done.
+func (j *Jsonnetizer) keepGoing(ctx context.Context, err error) bool {
+	if !j.KeepGoing || ctx.Err() != nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.failures = append(j.failures, err)
+	return true
+}
+
+// outcome is the result of processing a file, available once done is closed.
+type outcome struct {
+	done chan struct{}
+	err  error
+}
+
+// processOnce calls process, unless it's already been called with key during
+// this Run, in which case it returns the same result once that call returns.
+func (j *Jsonnetizer) processOnce(key string, process func() error) error {
+	j.mu.Lock()
+	o, ok := j.processed[key]
+	if ok {
+		j.mu.Unlock()
+		<-o.done
+		return o.err
+	}
+	if j.processed == nil {
+		j.processed = map[string]*outcome{}
+	}
+	o = &outcome{done: make(chan struct{})}
+	j.processed[key] = o
+	j.mu.Unlock()
+
+	o.err = process()
+	close(o.done)
+	return o.err
+}
+
+// mkdirAll creates dir and any missing parents, as os.MkdirAll does. Only one
+// directory is created at a time, and each only once per Run.
+func (j *Jsonnetizer) mkdirAll(dir string) error {
+	j.dirMu.Lock()
+	defer j.dirMu.Unlock()
+	if j.dirs[dir] {
+		return nil
+	}
+	err := j.fs().MkdirAll(dir, j.dirMode())
+	if err != nil {
+		return err
+	}
+	if j.dirs == nil {
+		j.dirs = map[string]bool{}
+	}
+	j.dirs[dir] = true
+	return nil
+}
+
+func (j *Jsonnetizer) logger() *Logger {
+	if j.Log == nil {
+		return defaultLogger
+	}
+	return j.Log
+}
+
+func (j *Jsonnetizer) jsonnetBin() string {
+	if j.JsonnetBin == "" {
+		return "jsonnet"
+	}
+	return j.JsonnetBin
+}
+
+func (j *Jsonnetizer) jobs() int {
+	if j.Jobs < 1 {
+		return 1
+	}
+	return j.Jobs
+}
+
+func (j *Jsonnetizer) buildConcurrency() int {
+	if j.BuildConcurrency < 1 {
+		return 1
+	}
+	return j.BuildConcurrency
+}
+
+// Run replicates the kustomization at root, and everything it references,
+// into Output. Cancelling ctx kills any jsonnet process still running. If
+// Base is set, root must be within it. Nothing is written should any local
+// file referred to be missing.
+func (j *Jsonnetizer) Run(ctx context.Context, root string) error {
+	if _, ok := j.relativeToBase(root); j.Base != "" && !ok {
+		return &ConfigError{fmt.Errorf("kustomization %s is outside the base directory %s", root, j.Base)}
+	}
+	err := preflight(root)
+	if err != nil {
+		return err
+	}
+
+	j.reset()
+	err = processKustomization(ctx, j, nil, root, "")
+	if err != nil {
+		return err
+	}
+	return j.failed()
+}
+
+// ProcessKustomization processes every file and kustomization k refers to as
+// Run would, as though k were the kustomization at root, returning a copy of
+// k with their paths replaced by those of their output. Nothing is written
+// for k itself, so a kustomization built in memory needn't be written to disk
+// first. With KeepGoing, the copy is returned along with any Errors.
+func (j *Jsonnetizer) ProcessKustomization(ctx context.Context, root string, k *types.Kustomization) (*types.Kustomization, error) {
+	if _, ok := j.relativeToBase(root); j.Base != "" && !ok {
+		return nil, &ConfigError{fmt.Errorf("kustomization %s is outside the base directory %s", root, j.Base)}
+	}
+	// a copy, deep enough that k is left as it was
+	data, err := yaml.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+	var kustomization kustomizationFile
+	err = yaml.Unmarshal(data, &kustomization)
+	if err != nil {
+		return nil, err
+	}
+
+	j.reset()
+	ancestors, err := visitKustomization(nil, root)
+	if err != nil {
+		return nil, err
+	}
+	j.visitRoot(ancestors[0])
+	err = readSidecar(j, root)
+	if err != nil {
+		return nil, err
+	}
+	err = processPaths(ctx, j, ancestors, root, &kustomization)
+	if err != nil {
+		return nil, err
+	}
+	return &kustomization.Kustomization, j.failed()
+}
+
+// reset forgets anything a previous run found, which may since have changed.
+func (j *Jsonnetizer) reset() {
+	j.mu.Lock()
+	j.actions, j.copied, j.fileVars, j.rootBins, j.visited, j.reports, j.trees, j.processed, j.failures = nil, nil, nil, nil, nil, nil, nil, nil, nil
+	j.done, j.total = 0, 0
+	j.mu.Unlock()
+	// Clean, or anything else, may have removed them
+	j.dirMu.Lock()
+	j.dirs = nil
+	j.dirMu.Unlock()
+}
+
+// progress adds found to the count of paths found and done to that of those
+// processed, logging the counts if Progress is set. They're logged under the
+// lock so that counts from concurrent paths are written in order.
+func (j *Jsonnetizer) progress(found, done int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.total += found
+	j.done += done
+	if j.Progress && done > 0 {
+		j.logger().Printf("processed %d/%d paths", j.done, j.total)
+	}
+}
+
+// failed returns the failures KeepGoing went past, if there were any, sorted
+// so that they're stable regardless of processing order.
+func (j *Jsonnetizer) failed() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.failures) > 0 {
+		sort.Slice(j.failures, func(a, b int) bool { return j.failures[a].Error() < j.failures[b].Error() })
+		return j.failures
+	}
+	return nil
+}
+
+// Eval evaluates the jsonnet file at path as Run would, with any arguments
+// the sidecar beside it gives it, returning the output in Format instead of
+// writing it anywhere.
+func (j *Jsonnetizer) Eval(ctx context.Context, path string) ([]byte, error) {
+	path = filepath.Clean(path)
+	err := readSidecar(j, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	err = j.checkImports(filepath.Dir(path), path)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := j.evaluateJsonnet(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	out, err = j.convertOutput(path, out)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't convert jsonnet output of %s to %s: %w", path, j.format(path), err)
+	}
+	return out, nil
+}
+
+// Clean removes the output of the kustomization at root before a Run.
+func (j *Jsonnetizer) Clean(root string) error {
+	if j.DryRun {
+		j.recordAction("clean", j.QualifyOutput(root, ""))
+		return nil
+	}
+	if _, ok := j.fs().(OSFS); !ok {
+		// nothing else lives there to protect
+		return j.fs().RemoveAll(j.QualifyOutput(root, ""))
+	}
+	return cleanOutput(j.QualifyOutput(root, ""), root)
+}
+
+// RequireEmptyOutput returns a ConfigError unless the output of the
+// kustomization at root is absent or empty, for a Run whose output mustn't
+// mix with what another left there. Only the OS filesystem is checked.
+func (j *Jsonnetizer) RequireEmptyOutput(root string) error {
+	if _, ok := j.fs().(OSFS); !ok {
+		return nil
+	}
+	dir := j.QualifyOutput(root, "")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return &ConfigError{fmt.Errorf("output %s isn't empty; clean it or choose another", dir)}
+	}
+	return nil
+}
+
+// Build runs kustomize build on the output of the kustomization at root.
+func (j *Jsonnetizer) Build(ctx context.Context, root string) error {
+	if _, ok := j.fs().(OSFS); !ok {
+		return &ConfigError{fmt.Errorf("kustomize can't build output outside the OS filesystem")}
+	}
+	return runKustomize(ctx, j, j.QualifyOutput(root, ""))
+}
+
+// BuildRoots runs Build on each of roots, already processed, up to
+// BuildConcurrency at a time, starting them in order. It returns the error of
+// each root's build at its index. Unless KeepGoing is set, no build is
+// started once one has failed; those left unbuilt have no error of their own.
+// Once every build has finished, the output of those which succeeded is
+// written in the order of roots, as one YAML stream.
+func (j *Jsonnetizer) BuildRoots(ctx context.Context, roots []string) []error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+	)
+	errs := make([]error, len(roots))
+	outs := make([][]byte, len(roots))
+	built := make([]bool, len(roots))
+	if _, ok := j.fs().(OSFS); !ok {
+		for i := range roots {
+			errs[i] = &ConfigError{fmt.Errorf("kustomize can't build output outside the OS filesystem")}
+		}
+		return errs
+	}
+	sem := make(chan struct{}, j.buildConcurrency())
+	for i, root := range roots {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+		mu.Lock()
+		stop := failed && !j.KeepGoing
+		mu.Unlock()
+		if errs[i] != nil || stop {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, root string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			out, err := kustomizeOutput(ctx, j, j.QualifyOutput(root, ""))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[i], failed = err, true
+				return
+			}
+			outs[i], built[i] = out, true
+		}(i, root)
+	}
+	wg.Wait()
+
+	var stream [][]byte
+	for i, out := range outs {
+		if built[i] {
+			stream = append(stream, out)
+		}
+	}
+	if len(stream) == 0 {
+		return errs
+	}
+	err := j.writeBuildOutput(stream...)
+	if err != nil {
+		// none of their output made it
+		for i := range roots {
+			if built[i] {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
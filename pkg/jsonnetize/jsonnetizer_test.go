@@ -0,0 +1,334 @@
+package jsonnetize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+func TestJsonnetizer_QualifyOutput(t *testing.T) {
+	j := Jsonnetizer{
+		Base:   "/abc/123",
+		Output: "/output/here",
+	}
+
+	assert.Equal(t, "/output/here/xyz/my.resource", j.QualifyOutput("/abc/123/xyz", "my.resource"))
+	assert.Equal(t, "/output/here/my.resource", j.QualifyOutput("/abc/123", "my.resource"))
+	// outside Base the full path is kept
+	assert.Equal(t, "/output/here/abc/lib/my.libsonnet", j.QualifyOutput("/abc/lib/my.libsonnet", ""))
+
+	j.Base = ""
+	assert.Equal(t, "/output/here/abc/123/xyz/my.resource", j.QualifyOutput("/abc/123/xyz", "my.resource"))
+}
+
+func TestProcessKustomization_Base(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "abc", "overlay", "kustomization.yml"), "resources:\n- ../base\n- a.yml\n")
+	writeFile(t, filepath.Join(src, "abc", "overlay", "a.yml"), `{}`)
+	writeFile(t, filepath.Join(src, "abc", "base", "kustomization.yml"), "resources:\n- b.yml\n")
+	writeFile(t, filepath.Join(src, "abc", "base", "b.yml"), `{}`)
+
+	out := t.TempDir()
+	j := Jsonnetizer{Base: filepath.Join(src, "abc"), Output: out}
+	assert.NoError(t, j.Run(context.Background(), filepath.Join(src, "abc", "overlay")))
+	assert.FileExists(t, filepath.Join(out, "overlay", "kustomization.yml"))
+	assert.FileExists(t, filepath.Join(out, "overlay", "a.yml"))
+	assert.FileExists(t, filepath.Join(out, "base", "b.yml"))
+
+	j.Base = filepath.Join(src, "abc", "overlay")
+	err := j.Run(context.Background(), filepath.Join(src, "abc", "overlay"))
+	assert.EqualError(t, err, fmt.Sprintf("processing resource %q under %q: kustomization %s is outside the base directory %s",
+		"../base", filepath.Join(src, "abc", "overlay"), filepath.Join(src, "abc", "base"), j.Base))
+
+	// the root itself is checked before anything is processed
+	j.Base = filepath.Join(src, "abc", "base")
+	err = j.Run(context.Background(), filepath.Join(src, "abc", "overlay"))
+	var configErr *ConfigError
+	assert.True(t, errors.As(err, &configErr), "%v", err)
+	assert.EqualError(t, err, fmt.Sprintf("kustomization %s is outside the base directory %s", filepath.Join(src, "abc", "overlay"), j.Base))
+}
+
+func TestProcessKustomization_OutputDir(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yaml"), "resources:\n- a.jsonnet\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+
+	// the kustomization lands beside its resources, whether the root is the
+	// base, within it, or there's no base at all
+	for _, base := range []string{src, filepath.Dir(src), ""} {
+		j := Jsonnetizer{Base: base, Output: t.TempDir()}
+		assert.NoError(t, j.Run(context.Background(), src))
+		dir := j.QualifyOutput(src, "")
+		assert.FileExists(t, filepath.Join(dir, "kustomization.yaml"), base)
+		assert.FileExists(t, filepath.Join(dir, "a.jsonnet.yml"), base)
+	}
+}
+
+func TestJsonnetizer_QualifyOutput_Windows(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("volume names only exist on windows")
+	}
+	j := Jsonnetizer{Output: `D:\output`}
+
+	assert.Equal(t, `D:\output\C\src\my.resource`, j.QualifyOutput(`C:\src`, "my.resource"))
+	assert.Equal(t, `D:\output\server\share\src\my.resource`, j.QualifyOutput(`\\server\share\src`, "my.resource"))
+}
+
+func TestJsonnetizer_MkdirAll(t *testing.T) {
+	out := t.TempDir()
+	j := Jsonnetizer{Output: out}
+
+	// overlapping prefixes, each created by many goroutines at once
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- j.mkdirAll(filepath.Join(out, "a", "b", strconv.Itoa(i%5), "c"))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.DirExists(t, filepath.Join(out, "a", "b", strconv.Itoa(i), "c"))
+	}
+	assert.Len(t, j.dirs, 5)
+}
+
+func TestJsonnetizer_Run(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	out, err := ioutil.ReadFile(j.QualifyOutput(src, "a.jsonnet.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: A\n", string(out))
+	kust, err := ioutil.ReadFile(j.QualifyOutput(src, "kustomization.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "resources:\n- a.jsonnet.yml\n", string(kust))
+}
+
+func TestJsonnetizer_Eval(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, sidecarName), "files:\n  a.jsonnet:\n    extStrs: [env=prod]\n")
+
+	j := Jsonnetizer{ExtStrs: []string{"env=default"}, Format: FormatJSON}
+	out, err := j.Eval(context.Background(), filepath.Join(src, "a.jsonnet"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"kind": "A"}`, string(out))
+	assert.Equal(t, []string{"--ext-str env=prod " + filepath.Join(src, "a.jsonnet")}, invocations())
+}
+
+func TestJsonnetizer_ProcessKustomization(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "patch.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- b.jsonnet\n")
+	writeFile(t, filepath.Join(src, "base", "b.jsonnet"), `{"kind": "B"}`)
+
+	k := &types.Kustomization{
+		Namespace: "foo",
+		Resources: []string{"a.jsonnet", "base", "https://example.com/remote.yml"},
+		Patches:   []types.Patch{{Path: "patch.jsonnet"}},
+	}
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	processed, err := j.ProcessKustomization(context.Background(), src, k)
+	assert.NoError(t, err)
+	assert.Equal(t, &types.Kustomization{
+		Namespace: "foo",
+		Resources: []string{"a.jsonnet.yml", "base", "https://example.com/remote.yml"},
+		Patches:   []types.Patch{{Path: "patch.jsonnet.yml"}},
+	}, processed)
+
+	// k is left alone, and only the files it refers to are written
+	assert.Equal(t, "a.jsonnet", k.Resources[0])
+	assert.Equal(t, "patch.jsonnet", k.Patches[0].Path)
+	assert.FileExists(t, j.QualifyOutput(src, "a.jsonnet.yml"))
+	assert.FileExists(t, j.QualifyOutput(src, "base/b.jsonnet.yml"))
+	assert.FileExists(t, j.QualifyOutput(src, "base/kustomization.yml"))
+	_, err = os.Stat(j.QualifyOutput(src, "kustomization.yml"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = j.ProcessKustomization(context.Background(), t.TempDir(), k)
+	var configErr *ConfigError
+	assert.True(t, errors.As(err, &configErr))
+}
+
+func TestJsonnetizer_RequireEmptyOutput(t *testing.T) {
+	src := t.TempDir()
+	j := Jsonnetizer{Base: src, Output: filepath.Join(t.TempDir(), "out")}
+
+	// absent
+	assert.NoError(t, j.RequireEmptyOutput(src))
+
+	// empty
+	assert.NoError(t, os.MkdirAll(j.Output, 0755))
+	assert.NoError(t, j.RequireEmptyOutput(src))
+
+	// non-empty, if only with another run's directory
+	assert.NoError(t, os.MkdirAll(filepath.Join(j.Output, "old"), 0755))
+	err := j.RequireEmptyOutput(src)
+	var configErr *ConfigError
+	assert.True(t, errors.As(err, &configErr), "%v", err)
+	assert.EqualError(t, err, fmt.Sprintf("output %s isn't empty; clean it or choose another", j.Output))
+
+	// another root's output is no concern of this one's
+	assert.NoError(t, j.RequireEmptyOutput(filepath.Join(src, "overlay")))
+}
+
+func TestJsonnetizer_Run_Progress(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.yml\n- b.jsonnet\n- base\n")
+	writeFile(t, filepath.Join(src, "a.yml"), "kind: A\n")
+	writeFile(t, filepath.Join(src, "b.jsonnet"), `{"kind": "B"}`)
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- c.jsonnet\n")
+	writeFile(t, filepath.Join(src, "base", "c.jsonnet"), `{"kind": "C"}`)
+
+	var log strings.Builder
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Jobs: 4, Progress: true, Log: NewLogger(&log, false)}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	// the base's path is only found once it's recursed into, and its
+	// directory is done once it is
+	var counts []int
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		var done, total int
+		_, err := fmt.Sscanf(line[strings.Index(line, "processed"):], "processed %d/%d paths", &done, &total)
+		assert.NoError(t, err, line)
+		assert.True(t, done <= total, line)
+		counts = append(counts, done)
+	}
+	assert.Equal(t, []int{1, 2, 3, 4}, counts)
+	assert.Contains(t, log.String(), "processed 4/4 paths")
+
+	// and nothing is logged without it
+	log.Reset()
+	j.Progress = false
+	assert.NoError(t, j.Run(context.Background(), src))
+	assert.Empty(t, log.String())
+}
+
+func TestJsonnetizer_Run_Cancel(t *testing.T) {
+	// records its pid, then hangs until killed
+	_, invocations := fakeBin(t, "jsonnet", "#!/bin/sh\necho $$ >> \"$FAKE_JSONNET_LOG\"\nexec sleep 30\n")
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	done := make(chan error, 1)
+	go func() { done <- j.Run(ctx, src) }()
+
+	for len(invocations()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after cancellation")
+	}
+	pid, err := strconv.Atoi(invocations()[0])
+	assert.NoError(t, err)
+	process, err := os.FindProcess(pid)
+	assert.NoError(t, err)
+	assert.Error(t, process.Signal(syscall.Signal(0)), "jsonnet is still running")
+}
+
+const fakeJsonnetScript = `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKE_JSONNET_LOG"
+out=
+while [ $# -gt 1 ]; do
+	if [ "$1" = "-o" ]; then out=$2; shift; fi
+	shift
+done
+if grep -q error "$1"; then
+	echo "RUNTIME ERROR: $1" >&2
+	exit 1
+fi
+if [ -n "$out" ]; then
+	cat "$1" > "$out"
+else
+	cat "$1"
+fi
+`
+
+const fakeKustomizeScript = `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKE_KUSTOMIZE_LOG"
+`
+
+// fakeJsonnet puts a stand-in jsonnet binary on the PATH which copies its
+// input to stdout (or the -o destination) and records its arguments. The
+// returned func reads back the recorded invocations.
+func fakeJsonnet(t *testing.T) func() []string {
+	_, invocations := fakeBin(t, "jsonnet", fakeJsonnetScript)
+	return invocations
+}
+
+// fakeBin puts script on the PATH as name, returning its location and a func
+// reading back the invocations the script records in $FAKE_<NAME>_LOG.
+func fakeBin(t *testing.T, name, script string) (string, func() []string) {
+	bin := t.TempDir()
+	logFile := filepath.Join(bin, "invocations.log")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755))
+
+	setenv(t, "PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setenv(t, "FAKE_"+strings.ToUpper(name)+"_LOG", logFile)
+
+	return filepath.Join(bin, name), func() []string {
+		bytes, err := ioutil.ReadFile(logFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		assert.NoError(t, err)
+		return strings.Split(strings.TrimSpace(string(bytes)), "\n")
+	}
+}
+
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	assert.NoError(t, os.Setenv(key, value))
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func writeFile(t *testing.T, path, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
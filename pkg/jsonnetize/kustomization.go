@@ -0,0 +1,747 @@
+package jsonnetize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+const (
+	ResourceType KustomizeType = iota
+	PluginType
+	PatchType
+	SourceType
+	SchemaType
+)
+
+var kustTypeMap = map[KustomizeType]string{
+	ResourceType: "Resource",
+	PluginType:   "Plugin",
+	PatchType:    "Patch",
+	SourceType:   "Source",
+	SchemaType:   "Schema",
+}
+
+type KustomizeType uint
+
+func (k KustomizeType) String() string {
+	return kustTypeMap[k]
+}
+
+func processResource(ctx context.Context, j *Jsonnetizer, ancestors []string, root, path string) ([]string, error) {
+	if !isLocalFile(path) {
+		j.logger().Debugf("%s is not a local file; leaving it alone", path)
+		j.report(ReportEntry{Root: root, Source: path, Action: ReportSkipped})
+		return []string{path}, nil
+	}
+
+	// symlinks are followed: a linked directory is processed as the
+	// kustomization it points to, and a linked file by its contents
+	si, err := os.Stat(filepath.Join(root, path))
+	if err != nil {
+		return nil, err
+	}
+
+	if si.IsDir() {
+		err = processKustomization(ctx, j, ancestors, root, path)
+		if err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+
+	var updatedPaths []string
+	if j.Multi {
+		updatedPaths, err = processMultiFileRef(ctx, j, root, path)
+	} else {
+		var updatedPath string
+		updatedPath, err = processFileRef(ctx, j, root, path)
+		updatedPaths = []string{updatedPath}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if j.Validate && !j.DryRun {
+		for _, updatedPath := range updatedPaths {
+			// only compiled output is checked; anything else is copied
+			// as it was written
+			if updatedPath == path {
+				continue
+			}
+			err = validateResource(j, j.QualifyOutput(root, updatedPath))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return updatedPaths, nil
+}
+
+// processPlugin handles a generator or transformer entry. kustomize loads a
+// directory entry as a kustomization whose resources are plugin configs, so
+// one with a kustomization file is processed as such; any other directory is
+// copied as it is. With CopySiblings, the directory holding a plugin config
+// file is copied along with it.
+func processPlugin(ctx context.Context, j *Jsonnetizer, ancestors []string, root, path string) (string, error) {
+	if !isLocalFile(path) {
+		return processFileRef(ctx, j, root, path)
+	}
+
+	si, err := os.Stat(filepath.Join(root, path))
+	if err != nil || !si.IsDir() {
+		updatedPath, err := processFileRef(ctx, j, root, path)
+		if err != nil {
+			return "", err
+		}
+		// only compiled output is checked, as with Validate
+		if j.KRM && !j.DryRun && updatedPath != path {
+			err = validateResourceList(j, j.QualifyOutput(root, updatedPath))
+			if err != nil {
+				return "", err
+			}
+		}
+		if !j.CopySiblings {
+			return updatedPath, nil
+		}
+		return updatedPath, copySiblings(j, root, path)
+	}
+	if _, _, err := findKustFile(filepath.Join(root, path)); err != nil {
+		err = j.checkWithinRoot(root, path)
+		if err != nil {
+			return "", err
+		}
+		return path, copyTree(j, root, path)
+	}
+	return path, processKustomization(ctx, j, ancestors, root, path)
+}
+
+// copySiblings copies the tree of the directory holding the plugin config at
+// root/path, for the data files the config may refer to. Kustomization files
+// are left to be rewritten, and hidden directories such as .git and the output
+// tree, should it be within, are skipped, as is anything ignored.
+func copySiblings(j *Jsonnetizer, root, path string) error {
+	output, err := filepath.Abs(j.Output)
+	if err != nil {
+		return err
+	}
+	patterns, err := j.ignorePatterns(root)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(root, filepath.Dir(path))
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		ignored, err := isIgnored(patterns, rel, d.IsDir())
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if abs, err := filepath.Abs(file); err == nil && abs == output {
+				return filepath.SkipDir
+			}
+			if file != dir && (strings.HasPrefix(d.Name(), ".") || ignored) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ignored || isKustFileName(d.Name()) || rel == filepath.Clean(path) || !isRegularFile(file) {
+			return nil
+		}
+		return copyFileRef(j, root, rel)
+	})
+}
+
+// processSource handles a configMapGenerator or secretGenerator source, which
+// may be a directory of files.
+func processSource(ctx context.Context, j *Jsonnetizer, root, path string) (string, error) {
+	si, err := os.Stat(filepath.Join(root, path))
+	if err == nil && si.IsDir() {
+		err = j.checkWithinRoot(root, path)
+		if err != nil {
+			return "", err
+		}
+		return path, copyTree(j, root, path)
+	}
+	return processFileRef(ctx, j, root, path)
+}
+
+// processKvSources processes the files and env files of a generator,
+// rewriting them in place and adding them to tree. File sources keep any key=
+// prefix they have; one without that is renamed is given its original base
+// name as key, which kustomize would otherwise take from its output. A glob
+// pattern among them is replaced by each file it matches, which it may only
+// be given a key for should it match one.
+func processKvSources(ctx context.Context, j *Jsonnetizer, ancestors []string, root string, sources *types.KvPairSources, tree *TreePaths) error {
+	var keys, paths []string
+	for _, source := range sources.FileSources {
+		key, path := "", source
+		if parts := strings.SplitN(source, "=", 2); len(parts) == 2 {
+			key, path = parts[0]+"=", parts[1]
+		}
+		if path == "" {
+			return fmt.Errorf("empty path as %s", root)
+		}
+		matches, err := expandGlobs(root, SourceType, []string{path})
+		if err != nil {
+			return err
+		}
+		if key != "" && len(matches) > 1 {
+			return pathError(SourceType, root, path, fmt.Errorf("pattern given key %s matches %d files", strings.TrimSuffix(key, "="), len(matches)))
+		}
+		tree.Original = append(tree.Original, path)
+		for _, match := range matches {
+			keys = append(keys, key)
+			paths = append(paths, match)
+		}
+	}
+
+	updatedPaths, err := processTypes(ctx, j, ancestors, root, SourceType, paths)
+	if err != nil {
+		return err
+	}
+	sources.FileSources = nil
+	for i, updatedPath := range updatedPaths {
+		tree.Rewritten = append(tree.Rewritten, updatedPath)
+		key := keys[i]
+		if key == "" && isLocalFile(paths[i]) && filepath.Base(updatedPath) != filepath.Base(paths[i]) {
+			key = filepath.Base(paths[i]) + "="
+		}
+		sources.FileSources = append(sources.FileSources, key+updatedPath)
+	}
+
+	envSources, err := processTypes(ctx, j, ancestors, root, SourceType, sources.EnvSources)
+	if err != nil {
+		return err
+	}
+	tree.Original = append(tree.Original, sources.EnvSources...)
+	tree.Rewritten = append(tree.Rewritten, envSources...)
+	sources.EnvSources = envSources
+	return nil
+}
+
+func processPatch(ctx context.Context, j *Jsonnetizer, root, path string) (string, error) {
+	j.logger().Debugf("Processing %s: %s", PatchType.String(), path)
+	return processFileRef(ctx, j, root, path)
+}
+
+// inlinePatch returns the path a patch at root/path is referred to by once
+// processed to updatedPath, or with Inline, should it have been compiled, an
+// empty path and its compiled output to embed in the kustomization instead.
+// kustomize only takes patches inline, so resources are never embedded.
+func inlinePatch(j *Jsonnetizer, root, path, updatedPath string) (string, string, error) {
+	if !j.Inline || j.DryRun || updatedPath == path {
+		return updatedPath, "", nil
+	}
+	data, err := readOutputFile(j, j.QualifyOutput(root, updatedPath))
+	if err != nil {
+		return "", "", err
+	}
+	return "", string(data), nil
+}
+
+// isInlinePatch reports whether a patchesStrategicMerge entry under root is
+// the patch itself rather than the path of one. Paths never span lines; a
+// single line is a path if there's a file there, and otherwise, as kustomize
+// has it, a patch if it reads as a YAML or JSON object.
+func isInlinePatch(root, patch string) bool {
+	if strings.Contains(patch, "\n") {
+		return true
+	}
+	if _, err := os.Stat(filepath.Join(root, patch)); err == nil {
+		return false
+	}
+	var node yaml.Node
+	return yaml.Unmarshal([]byte(patch), &node) == nil && len(node.Content) > 0 && node.Content[0].Kind == yaml.MappingNode
+}
+
+// pathError gives err the context of the path being processed when it
+// occurred.
+func pathError(kustType KustomizeType, root, path string, err error) error {
+	return fmt.Errorf("processing %s %q under %q: %w", strings.ToLower(kustType.String()), path, root, err)
+}
+
+func processType(ctx context.Context, j *Jsonnetizer, ancestors []string, root string, kustType KustomizeType, path string) ([]string, error) {
+	// strategic merge patches may be given inline, and are left as they are
+	if kustType == PatchType && isInlinePatch(root, path) {
+		return []string{path}, nil
+	}
+	j.logger().Debugf("Processing %s: %s", kustType.String(), path)
+	switch kustType {
+	case ResourceType:
+		return processResource(ctx, j, ancestors, root, path)
+	case PluginType:
+		updatedPath, err := processPlugin(ctx, j, ancestors, root, path)
+		if err != nil {
+			return nil, err
+		}
+		return []string{updatedPath}, nil
+	case PatchType:
+		// like resources, a file of several patches may be split up
+		var updatedPaths []string
+		var err error
+		if j.Multi {
+			updatedPaths, err = processMultiFileRef(ctx, j, root, path)
+		} else {
+			var updatedPath string
+			updatedPath, err = processFileRef(ctx, j, root, path)
+			updatedPaths = []string{updatedPath}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, updatedPath := range updatedPaths {
+			// an inline patch stands in for its path
+			updatedPath, patch, err := inlinePatch(j, root, path, updatedPath)
+			if err != nil {
+				return nil, err
+			}
+			if updatedPath == "" {
+				updatedPaths[i] = patch
+			}
+		}
+		return updatedPaths, nil
+	case SourceType:
+		updatedPath, err := processSource(ctx, j, root, path)
+		if err != nil {
+			return nil, err
+		}
+		return []string{updatedPath}, nil
+	case SchemaType:
+		updatedPath, err := processFileRef(ctx, j, root, path)
+		if err != nil {
+			return nil, err
+		}
+		return []string{updatedPath}, nil
+	}
+	return nil, fmt.Errorf("unknown kustomize type %d", kustType)
+}
+
+// processTypes processes paths concurrently, up to j.Jobs at a time, keeping
+// the rewritten paths in their original order. Once any path fails no further
+// paths are started and the first error is returned, as is ctx's error if it's
+// done before every path has started. With KeepGoing, a failed path is instead
+// recorded for Run to return, and kept as it was.
+func processTypes(ctx context.Context, j *Jsonnetizer, ancestors []string, root string, kustType KustomizeType, paths []string) ([]string, error) {
+	for _, path := range paths {
+		if path == "" {
+			return nil, fmt.Errorf("empty path as %s", root)
+		}
+	}
+	paths, err := expandGlobs(root, kustType, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	results := make([][]string, len(paths))
+	j.progress(len(paths), 0)
+	sem := make(chan struct{}, j.jobs())
+	for i, path := range paths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			mu.Unlock()
+		}
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			updatedPaths, err := processType(ctx, j, ancestors, root, kustType, path)
+			j.progress(0, 1)
+			if err != nil {
+				err = pathError(kustType, root, path, err)
+				if j.keepGoing(ctx, err) {
+					results[i] = []string{path}
+					return
+				}
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			results[i] = updatedPaths
+		}(i, path)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var finalResources []string
+	for _, updatedPaths := range results {
+		finalResources = append(finalResources, updatedPaths...)
+	}
+	return finalResources, nil
+}
+
+// expandGlobs replaces each local path of paths which is a glob pattern, such
+// as configs/*.yaml, with the paths under root it matches, in lexical order,
+// for them to be processed as though listed. A path naming an existing file
+// is taken literally, and a pattern matching nothing is an error.
+func expandGlobs(root string, kustType KustomizeType, paths []string) ([]string, error) {
+	var expanded []string
+	for _, path := range paths {
+		if !isLocalFile(path) || !strings.ContainsAny(path, "*?[") || (kustType == PatchType && isInlinePatch(root, path)) {
+			expanded = append(expanded, path)
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(root, path)); err == nil {
+			expanded = append(expanded, path)
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(root, path))
+		if err != nil {
+			return nil, pathError(kustType, root, path, err)
+		}
+		if len(matches) == 0 {
+			return nil, pathError(kustType, root, path, errors.New("pattern matches no files"))
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(root, match)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, filepath.ToSlash(rel))
+		}
+	}
+	return expanded, nil
+}
+
+// kustFileNames are the names kustomize looks for a kustomization file under,
+// in its order of precedence. Any of them may hold YAML or JSON.
+var kustFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// findKustFile returns the path of the kustomization file in root, along with
+// which of kustFileNames it has, for its output to be given the same.
+func findKustFile(root string) (string, string, error) {
+	for _, name := range kustFileNames {
+		path := filepath.Join(root, name)
+		si, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !si.Mode().IsRegular() {
+			return "", "", fmt.Errorf("%s is not a file", path)
+		}
+		return path, name, nil
+	}
+	return "", "", fmt.Errorf("couldn't find kustomization file in %s", root)
+}
+
+func isKustFileName(name string) bool {
+	for _, kustFileName := range kustFileNames {
+		if name == kustFileName {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveKustRoot returns the kustomization root for arg, which may be either
+// the root directory itself or a kustomization file within it.
+func ResolveKustRoot(arg string) (string, error) {
+	si, err := os.Stat(arg)
+	if err != nil {
+		return "", &ConfigError{err}
+	}
+
+	if si.IsDir() {
+		return arg, nil
+	}
+	if !isKustFileName(si.Name()) {
+		return "", &ConfigError{fmt.Errorf("argument must be a kustomization root or file: %s", arg)}
+	}
+	return filepath.Dir(arg), nil
+}
+
+// KustRootFromReader writes the kustomization file read from r into a new
+// temporary root, which the caller should remove when done with it. Only the
+// kustomization itself is written, so the local files it refers to won't
+// resolve; remote references and inline content such as literal generators
+// are all it can use.
+func KustRootFromReader(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := os.MkdirTemp("", "jsonnetize-stdin-")
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "kustomization.yaml"), data, 0644)
+	if err != nil {
+		os.RemoveAll(root)
+		return "", err
+	}
+	return root, nil
+}
+
+// visitKustomization appends root to ancestors, failing if it's already
+// among them. Roots are compared by their absolute, symlink-free paths.
+func visitKustomization(ancestors []string, root string) ([]string, error) {
+	resolved, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err = filepath.EvalSymlinks(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ancestor := range ancestors {
+		if ancestor == resolved {
+			chain := append(append([]string{}, ancestors...), resolved)
+			return nil, fmt.Errorf("cycle detected: %s", strings.Join(chain, " -> "))
+		}
+	}
+	// copy so that sibling kustomizations don't share a backing array
+	return append(append([]string{}, ancestors...), resolved), nil
+}
+
+// kustomizationFile is a kustomization as it's read from disk, along with the
+// fields added to kustomize since the version of its types used here.
+type kustomizationFile struct {
+	types.Kustomization `yaml:",inline"`
+
+	// OpenAPI holds the path of an OpenAPI schema, or the version of the
+	// builtin one, to be used in place of kustomize's default.
+	OpenAPI map[string]string `yaml:"openapi,omitempty"`
+}
+
+// processKustomization rewrites the kustomization at oldRoot/resource;
+// ancestors holds the resolved roots of the kustomizations leading to it.
+func processKustomization(ctx context.Context, j *Jsonnetizer, ancestors []string, oldRoot, resource string) error {
+	root := filepath.Join(oldRoot, resource)
+	ancestors, err := visitKustomization(ancestors, root)
+	if err != nil {
+		return err
+	}
+	j.visitRoot(ancestors[len(ancestors)-1])
+	// relative references between kustomizations only survive if they're
+	// mirrored together
+	if _, ok := j.relativeToBase(root); j.Base != "" && !ok {
+		return fmt.Errorf("kustomization %s is outside the base directory %s", root, j.Base)
+	}
+
+	kust, kustName, err := findKustFile(root)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := ioutil.ReadFile(kust)
+	if err != nil {
+		return err
+	}
+
+	var kustomization kustomizationFile
+	err = yaml.Unmarshal(bytes, &kustomization)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", kust, err)
+	}
+
+	err = readSidecar(j, root)
+	if err != nil {
+		return err
+	}
+
+	err = processPaths(ctx, j, ancestors, root, &kustomization)
+	if err != nil {
+		return err
+	}
+
+	bytes, err = rewriteKustomization(bytes, &kustomization)
+	if err != nil {
+		return fmt.Errorf("couldn't rewrite %s: %w", kust, err)
+	}
+
+	// qualified like the files it refers to, so that it's written beside
+	// them, under the same name as it had
+	output := j.QualifyOutput(root, kustName)
+	if j.DryRun {
+		j.recordAction("write", output)
+		return nil
+	}
+
+	// a kustomization composed purely of directories has no other output
+	// to create its directory, so writeOutputFile must take care of it
+	return writeOutputFile(j, output, bytes)
+}
+
+// processPaths processes every file and kustomization k, the kustomization at
+// root, refers to, replacing their paths with those of their output.
+func processPaths(ctx context.Context, j *Jsonnetizer, ancestors []string, root string, k *kustomizationFile) error {
+	node := &TreeNode{Root: root}
+	defer j.recordTree(ancestors, node)
+
+	// resources
+	node.Resources.Original = k.Resources
+	resources, err := processTypes(ctx, j, ancestors, root, ResourceType, k.Resources)
+	if err != nil {
+		return err
+	}
+	k.Resources = resources
+	node.Resources.Rewritten = resources
+
+	// components
+	node.Components.Original = k.Components
+	components, err := processTypes(ctx, j, ancestors, root, ResourceType, k.Components)
+	if err != nil {
+		return err
+	}
+	k.Components = components
+	node.Components.Rewritten = components
+
+	// bases (deprecated, but still honored by kustomize)
+	node.Bases.Original = k.Bases
+	bases, err := processTypes(ctx, j, ancestors, root, ResourceType, k.Bases)
+	if err != nil {
+		return err
+	}
+	k.Bases = bases
+	node.Bases.Rewritten = bases
+
+	// generators
+	node.Generators.Original = k.Generators
+	generators, err := processTypes(ctx, j, ancestors, root, PluginType, k.Generators)
+	if err != nil {
+		return err
+	}
+	k.Generators = generators
+	node.Generators.Rewritten = generators
+
+	// transformers
+	node.Transformers.Original = k.Transformers
+	transformers, err := processTypes(ctx, j, ancestors, root, PluginType, k.Transformers)
+	if err != nil {
+		return err
+	}
+	k.Transformers = transformers
+	node.Transformers.Rewritten = transformers
+
+	// patches; entries without a path carry their patch inline
+	for i, patch := range k.Patches {
+		if patch.Path == "" {
+			continue
+		}
+		updatedPath, err := processPatch(ctx, j, root, patch.Path)
+		if err == nil {
+			k.Patches[i].Path, k.Patches[i].Patch, err = inlinePatch(j, root, patch.Path, updatedPath)
+		}
+		if err != nil {
+			err = pathError(PatchType, root, patch.Path, err)
+			if !j.keepGoing(ctx, err) {
+				return err
+			}
+			k.Patches[i].Path, updatedPath = patch.Path, patch.Path
+		}
+		node.Patches.add(patch.Path, updatedPath)
+	}
+
+	var strategicMerge []string
+	for _, patch := range k.PatchesStrategicMerge {
+		strategicMerge = append(strategicMerge, string(patch))
+	}
+	node.PatchesStrategicMerge.Original = strategicMerge
+	strategicMerge, err = processTypes(ctx, j, ancestors, root, PatchType, strategicMerge)
+	if err != nil {
+		return err
+	}
+	node.PatchesStrategicMerge.Rewritten = strategicMerge
+	k.PatchesStrategicMerge = nil
+	for _, patch := range strategicMerge {
+		k.PatchesStrategicMerge = append(k.PatchesStrategicMerge, types.PatchStrategicMerge(patch))
+	}
+
+	for i, patch := range k.PatchesJson6902 {
+		if patch.Path == "" {
+			continue
+		}
+		updatedPath, err := processPatch(ctx, j, root, patch.Path)
+		if err == nil {
+			k.PatchesJson6902[i].Path, k.PatchesJson6902[i].Patch, err = inlinePatch(j, root, patch.Path, updatedPath)
+		}
+		if err != nil {
+			err = pathError(PatchType, root, patch.Path, err)
+			if !j.keepGoing(ctx, err) {
+				return err
+			}
+			k.PatchesJson6902[i].Path, updatedPath = patch.Path, patch.Path
+		}
+		node.PatchesJson6902.add(patch.Path, updatedPath)
+	}
+
+	// schemas
+	node.Crds.Original = k.Crds
+	crds, err := processTypes(ctx, j, ancestors, root, SchemaType, k.Crds)
+	if err != nil {
+		return err
+	}
+	k.Crds = crds
+	node.Crds.Rewritten = crds
+
+	if path := k.OpenAPI["path"]; path != "" {
+		k.OpenAPI["path"], err = processFileRef(ctx, j, root, path)
+		if err != nil {
+			err = pathError(SchemaType, root, path, err)
+			if !j.keepGoing(ctx, err) {
+				return err
+			}
+			k.OpenAPI["path"] = path
+		}
+		node.OpenAPI.add(path, k.OpenAPI["path"])
+	}
+
+	// generator sources
+	for i := range k.ConfigMapGenerator {
+		err = processKvSources(ctx, j, ancestors, root, &k.ConfigMapGenerator[i].KvPairSources, &node.Sources)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range k.SecretGenerator {
+		err = processKvSources(ctx, j, ancestors, root, &k.SecretGenerator[i].KvPairSources, &node.Sources)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
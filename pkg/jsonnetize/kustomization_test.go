@@ -0,0 +1,796 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+func TestResolveKustRoot(t *testing.T) {
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "some", "dir")
+	assert.NoError(t, os.MkdirAll(dir, os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte("resources: []\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other.yaml"), []byte("{}\n"), 0644))
+
+	root, err := ResolveKustRoot(filepath.Join(dir, "kustomization.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, dir, root)
+
+	root, err = ResolveKustRoot(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, dir, root)
+
+	_, err = ResolveKustRoot(filepath.Join(dir, "other.yaml"))
+	assert.Error(t, err)
+}
+
+func TestProcessKustomization_KustFileNames(t *testing.T) {
+	fakeJsonnet(t)
+	for _, name := range kustFileNames {
+		for _, content := range []string{"resources:\n- a.jsonnet\n", `{"resources": ["a.jsonnet"]}`} {
+			src := t.TempDir()
+			writeFile(t, filepath.Join(src, name), content)
+			writeFile(t, filepath.Join(src, "a.jsonnet"), `{}`)
+
+			j := Jsonnetizer{Base: src, Output: t.TempDir()}
+			assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""), name)
+			assert.Equal(t, []string{"a.jsonnet.yml"}, readKustomization(t, j.QualifyOutput(src, name)).Resources, name)
+
+			out, err := ioutil.ReadFile(j.QualifyOutput(src, name))
+			assert.NoError(t, err)
+			assert.Equal(t, content[0] == '{', bytes.HasPrefix(out, []byte("{")), "%s should keep its format", name)
+		}
+	}
+}
+
+func TestFindKustFile_Precedence(t *testing.T) {
+	src := t.TempDir()
+	for i := len(kustFileNames) - 1; i >= 0; i-- {
+		writeFile(t, filepath.Join(src, kustFileNames[i]), "resources: []\n")
+		kust, name, err := findKustFile(src)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(src, kustFileNames[i]), kust)
+		assert.Equal(t, kustFileNames[i], name)
+	}
+	assert.Equal(t, []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}, kustFileNames)
+}
+
+func TestProcessKustomization_KustFileName(t *testing.T) {
+	// the output keeps whichever name the kustomization file had
+	for _, name := range kustFileNames {
+		src := t.TempDir()
+		writeFile(t, filepath.Join(src, name), "namespace: foo\n")
+
+		j := Jsonnetizer{Base: src, Output: t.TempDir()}
+		assert.NoError(t, j.Run(context.Background(), src))
+		assert.FileExists(t, j.QualifyOutput(src, name))
+		for _, other := range kustFileNames {
+			if other != name {
+				_, err := os.Stat(j.QualifyOutput(src, other))
+				assert.True(t, os.IsNotExist(err), "%s from %s", other, name)
+			}
+		}
+	}
+}
+
+func TestKustRootFromReader(t *testing.T) {
+	root, err := KustRootFromReader(strings.NewReader("resources:\n- github.com/org/repo//base?ref=v1\n"))
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	kust, _, err := findKustFile(root)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"github.com/org/repo//base?ref=v1"}, readKustomization(t, kust).Resources)
+}
+
+func TestProcessResource_Multi(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "list.jsonnet"), `[{"kind": "Namespace"}, {"kind": "Deployment"}]`)
+	writeFile(t, filepath.Join(src, "single.jsonnet"), `{"kind": "Service"}`)
+
+	out := t.TempDir()
+	j := Jsonnetizer{Base: src, Output: out, Multi: true}
+
+	updated, err := processResource(context.Background(), &j, nil, src, "list.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"list.jsonnet.0.yml", "list.jsonnet.1.yml"}, updated)
+
+	bytes, err := ioutil.ReadFile(j.QualifyOutput(src, "list.jsonnet.1.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: Deployment\n", string(bytes))
+
+	updated, err = processResource(context.Background(), &j, nil, src, "single.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"single.jsonnet.yml"}, updated)
+}
+
+func TestProcessKustomization_MultiPatches(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.yml\npatchesStrategicMerge:\n- first.yml\n- patches.jsonnet\n- last.yml\n")
+	writeFile(t, filepath.Join(src, "a.yml"), "kind: A\n")
+	writeFile(t, filepath.Join(src, "first.yml"), "kind: First\n")
+	writeFile(t, filepath.Join(src, "patches.jsonnet"), `[{"kind": "One"}, {"kind": "Two"}, {"kind": "Three"}]`)
+	writeFile(t, filepath.Join(src, "last.yml"), "kind: Last\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Multi: true}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	var k kustomizationFile
+	bytes, err := ioutil.ReadFile(j.QualifyOutput(src, "kustomization.yml"))
+	assert.NoError(t, err)
+	assert.NoError(t, yaml.Unmarshal(bytes, &k))
+	assert.Equal(t, []types.PatchStrategicMerge{"first.yml", "patches.jsonnet.0.yml", "patches.jsonnet.1.yml", "patches.jsonnet.2.yml", "last.yml"}, k.PatchesStrategicMerge)
+
+	for i, kind := range []string{"One", "Two", "Three"} {
+		bytes, err := ioutil.ReadFile(j.QualifyOutput(src, fmt.Sprintf("patches.jsonnet.%d.yml", i)))
+		assert.NoError(t, err)
+		assert.Equal(t, "kind: "+kind+"\n", string(bytes))
+	}
+}
+
+func TestProcessResource_Symlinks(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "real", "kustomization.yml"), "resources:\n- a.yml\n")
+	writeFile(t, filepath.Join(src, "real", "a.yml"), `{}`)
+	writeFile(t, filepath.Join(src, "target.yml"), "kind: A\n")
+	assert.NoError(t, os.Symlink("real", filepath.Join(src, "linked")))
+	assert.NoError(t, os.Symlink("target.yml", filepath.Join(src, "file.yml")))
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+
+	updated, err := processResource(context.Background(), &j, nil, src, "linked")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linked"}, updated)
+	assert.FileExists(t, j.QualifyOutput(src, "linked/kustomization.yml"))
+	assert.FileExists(t, j.QualifyOutput(src, "linked/a.yml"))
+
+	updated, err = processResource(context.Background(), &j, nil, src, "file.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file.yml"}, updated)
+	si, err := os.Lstat(j.QualifyOutput(src, "file.yml"))
+	assert.NoError(t, err)
+	assert.True(t, si.Mode().IsRegular(), "the link should be copied as a file")
+	bytes, err := ioutil.ReadFile(j.QualifyOutput(src, "file.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: A\n", string(bytes))
+}
+
+func readKustomization(t *testing.T, path string) kustomizationFile {
+	bytes, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	var kustomization kustomizationFile
+	assert.NoError(t, yaml.Unmarshal(bytes, &kustomization))
+	return kustomization
+}
+
+func TestProcessKustomization_ComponentsAndBases(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "overlay", "kustomization.yml"), "components:\n- ../component\nbases:\n- ../base\n")
+	writeFile(t, filepath.Join(src, "component", "kustomization.yml"), "kind: Component\nresources:\n- cm.jsonnet\n")
+	writeFile(t, filepath.Join(src, "component", "cm.jsonnet"), `{"kind": "ConfigMap"}`)
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- ns.jsonnet\n")
+	writeFile(t, filepath.Join(src, "base", "ns.jsonnet"), `{"kind": "Namespace"}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, "overlay"))
+
+	overlay := readKustomization(t, j.QualifyOutput(src, "overlay/kustomization.yml"))
+	assert.Equal(t, []string{"../component"}, overlay.Components)
+	assert.Equal(t, []string{"../base"}, overlay.Bases)
+
+	component := readKustomization(t, j.QualifyOutput(src, "component/kustomization.yml"))
+	assert.Equal(t, []string{"cm.jsonnet.yml"}, component.Resources)
+	assert.FileExists(t, j.QualifyOutput(src, "component/cm.jsonnet.yml"))
+
+	base := readKustomization(t, j.QualifyOutput(src, "base/kustomization.yml"))
+	assert.Equal(t, []string{"ns.jsonnet.yml"}, base.Resources)
+	assert.FileExists(t, j.QualifyOutput(src, "base/ns.jsonnet.yml"))
+}
+
+func TestProcessKustomization_Patches(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `patches:
+- path: patch.jsonnet
+patchesStrategicMerge:
+- smp.jsonnet
+- smp.yml
+patchesJson6902:
+- target:
+    kind: Deployment
+    name: foo
+  path: json6902.jsonnet
+`)
+	for _, name := range []string{"patch.jsonnet", "smp.jsonnet", "smp.yml", "json6902.jsonnet"} {
+		writeFile(t, filepath.Join(src, name), `{}`)
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, "patch.jsonnet.yml", kustomization.Patches[0].Path)
+	assert.Equal(t, []types.PatchStrategicMerge{"smp.jsonnet.yml", "smp.yml"}, kustomization.PatchesStrategicMerge)
+	assert.Equal(t, "json6902.jsonnet.yml", kustomization.PatchesJson6902[0].Path)
+	for _, name := range []string{"patch.jsonnet.yml", "smp.jsonnet.yml", "smp.yml", "json6902.jsonnet.yml"} {
+		assert.FileExists(t, j.QualifyOutput(src, name))
+	}
+}
+
+func TestProcessKustomization_CopySiblings(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "generators:\n- plugins/generator.jsonnet\n")
+	writeFile(t, filepath.Join(src, "plugins", "generator.jsonnet"), `{"template": "templates/cm.tmpl"}`)
+	writeFile(t, filepath.Join(src, "plugins", "templates", "cm.tmpl"), "data: {}\n")
+	writeFile(t, filepath.Join(src, "plugins", ".git", "HEAD"), "ref: main\n")
+	writeFile(t, filepath.Join(src, "unrelated.yml"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+	_, err := os.Stat(j.QualifyOutput(src, "plugins/templates/cm.tmpl"))
+	assert.True(t, os.IsNotExist(err), "siblings are only copied when asked to")
+
+	j.CopySiblings = true
+	assert.NoError(t, j.Run(context.Background(), src))
+	assert.FileExists(t, j.QualifyOutput(src, "plugins/generator.jsonnet.yml"))
+	assert.FileExists(t, j.QualifyOutput(src, "plugins/templates/cm.tmpl"))
+	for _, name := range []string{"plugins/generator.jsonnet", "plugins/.git/HEAD", "unrelated.yml"} {
+		_, err = os.Stat(j.QualifyOutput(src, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestProcessKustomization_Schemas(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `crds:
+- widget.jsonnet
+- gadget.yaml
+openapi:
+  path: schema.jsonnet
+`)
+	for _, name := range []string{"widget.jsonnet", "gadget.yaml", "schema.jsonnet"} {
+		writeFile(t, filepath.Join(src, name), `{}`)
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, []string{"widget.jsonnet.yml", "gadget.yaml"}, kustomization.Crds)
+	assert.Equal(t, map[string]string{"path": "schema.jsonnet.yml"}, kustomization.OpenAPI)
+	for _, name := range []string{"widget.jsonnet.yml", "gadget.yaml", "schema.jsonnet.yml"} {
+		assert.FileExists(t, j.QualifyOutput(src, name))
+	}
+}
+
+func TestIsInlinePatch(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "smp.jsonnet"), `{}`)
+	writeFile(t, filepath.Join(root, "{odd}.yml"), "kind: Service\n")
+
+	for patch, inline := range map[string]bool{
+		"kind: Deployment\nmetadata:\n  name: foo": true,
+		`{"kind": "Service"}`:                      true,
+		"kind: Service":                            true,
+		"smp.jsonnet":                              false,
+		"{odd}.yml":                                false,
+		// left for preflight to report as missing
+		"missing.yml": false,
+	} {
+		assert.Equal(t, inline, isInlinePatch(root, patch), patch)
+	}
+}
+
+func TestJsonnetizer_Run_Inline(t *testing.T) {
+	fakeJsonnet(t)
+	_, builds := fakeBin(t, "kustomize", fakeKustomizeScript)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `resources:
+- a.jsonnet
+patches:
+- path: patch.jsonnet
+  target:
+    kind: Deployment
+- path: plain.yml
+patchesStrategicMerge:
+- smp.jsonnet
+patchesJson6902:
+- path: ops.jsonnet
+  target:
+    kind: Service
+    name: a
+`)
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "patch.jsonnet"), `{"kind": "Deployment", "spec": {"replicas": 2}}`)
+	writeFile(t, filepath.Join(src, "plain.yml"), "kind: Deployment\n")
+	writeFile(t, filepath.Join(src, "smp.jsonnet"), `{"kind": "Service", "metadata": {"name": "a"}}`)
+	writeFile(t, filepath.Join(src, "ops.jsonnet"), `[{"op": "remove", "path": "/spec"}]`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Inline: true}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	out, err := ioutil.ReadFile(j.QualifyOutput(src, "kustomization.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, `resources:
+  - a.jsonnet.yml
+patches:
+  - patch: |
+      kind: Deployment
+      spec:
+        replicas: 2
+    target:
+      kind: Deployment
+  - path: plain.yml
+patchesStrategicMerge:
+  - |
+    kind: Service
+    metadata:
+      name: a
+patchesJson6902:
+  - patch: |
+      - op: remove
+        path: /spec
+    target:
+      kind: Service
+      name: a
+`, string(out))
+
+	// resources can't be inline, and kustomize builds what it's given
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, "", kustomization.Patches[0].Path)
+	assert.Equal(t, "kind: Deployment\nspec:\n  replicas: 2\n", kustomization.Patches[0].Patch)
+	assert.NoError(t, j.Build(context.Background(), src))
+	assert.Equal(t, []string{"build " + j.QualifyOutput(src, "")}, builds())
+}
+
+func TestProcessKustomization_InlinePatches(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `patches:
+- patch: |-
+    - op: remove
+      path: /spec
+  target:
+    kind: Deployment
+- path: patch.jsonnet
+patchesStrategicMerge:
+- |-
+  apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: foo
+- '{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "foo"}}'
+- smp.jsonnet
+patchesJson6902:
+- target:
+    kind: Deployment
+    name: foo
+  patch: '[{"op": "remove", "path": "/spec"}]'
+`)
+	for _, name := range []string{"patch.jsonnet", "smp.jsonnet"} {
+		writeFile(t, filepath.Join(src, name), `{}`)
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Jobs: 1}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, "- op: remove\n  path: /spec", kustomization.Patches[0].Patch)
+	assert.Equal(t, "", kustomization.Patches[0].Path)
+	assert.Equal(t, "patch.jsonnet.yml", kustomization.Patches[1].Path)
+	assert.Equal(t, []types.PatchStrategicMerge{
+		"apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: foo",
+		`{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "foo"}}`,
+		"smp.jsonnet.yml",
+	}, kustomization.PatchesStrategicMerge)
+	assert.Equal(t, `[{"op": "remove", "path": "/spec"}]`, kustomization.PatchesJson6902[0].Patch)
+	assert.Len(t, invocations(), 2)
+	assert.Len(t, j.Report(), 2, "inline patches aren't files to report")
+}
+
+func TestProcessTypes_Jobs(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+
+	var paths, expected []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("r%d.jsonnet", i)
+		writeFile(t, filepath.Join(src, name), `{}`)
+		paths = append(paths, name)
+		expected = append(expected, name+".yml")
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Jobs: 4}
+	updated, err := processTypes(context.Background(), &j, nil, src, ResourceType, paths)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, updated)
+
+	writeFile(t, filepath.Join(src, "r7.jsonnet"), `error "boom"`)
+	j = Jsonnetizer{Base: src, Output: t.TempDir(), Jobs: 4}
+	_, err = processTypes(context.Background(), &j, nil, src, ResourceType, paths)
+	assert.Error(t, err)
+}
+
+func TestProcessKustomization_SharedFiles(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a\n- b\n")
+	for _, name := range []string{"a", "b"} {
+		writeFile(t, filepath.Join(src, name, "kustomization.yml"), "resources:\n- ../shared/cm.jsonnet\n- ../shared/plain.yml\n")
+	}
+	writeFile(t, filepath.Join(src, "shared", "cm.jsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "shared", "plain.yml"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), AllowEscape: true}
+	assert.NoError(t, j.Run(context.Background(), src))
+	assert.Len(t, invocations(), 1)
+	assert.FileExists(t, j.QualifyOutput(src, "shared/cm.jsonnet.yml"))
+	for _, name := range []string{"a", "b"} {
+		kustomization := readKustomization(t, j.QualifyOutput(src, name+"/kustomization.yml"))
+		assert.Equal(t, []string{"../shared/cm.jsonnet.yml", "../shared/plain.yml"}, kustomization.Resources)
+	}
+
+	// each reference is still reported
+	var sources []string
+	for _, entry := range j.Report() {
+		sources = append(sources, filepath.Join(entry.Root, entry.Source))
+	}
+	assert.Equal(t, 2, strings.Count(strings.Join(sources, " "), filepath.Join(src, "shared", "cm.jsonnet")))
+
+	// a new run starts afresh
+	assert.NoError(t, j.Run(context.Background(), src))
+	assert.Len(t, invocations(), 2)
+}
+
+func TestJsonnetizer_Run_KeepGoing(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- good.jsonnet\n- bad1.jsonnet\n- bad2.jsonnet\npatches:\n- path: bad3.jsonnet\n")
+	writeFile(t, filepath.Join(src, "good.jsonnet"), `{}`)
+	for _, name := range []string{"bad1.jsonnet", "bad2.jsonnet", "bad3.jsonnet"} {
+		writeFile(t, filepath.Join(src, name), `error "boom"`)
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), KeepGoing: true}
+	err := j.Run(context.Background(), src)
+	var errs Errors
+	assert.True(t, errors.As(err, &errs), "%v", err)
+	assert.Len(t, errs, 3)
+	for _, name := range []string{"bad1.jsonnet", "bad2.jsonnet", "bad3.jsonnet"} {
+		assert.Contains(t, err.Error(), name)
+	}
+	var jsonnetErr *JsonnetError
+	assert.True(t, errors.As(err, &jsonnetErr))
+
+	// everything else is processed, and failed paths kept as they were
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, []string{"good.jsonnet.yml", "bad1.jsonnet", "bad2.jsonnet"}, kustomization.Resources)
+	assert.Equal(t, "bad3.jsonnet", kustomization.Patches[0].Path)
+	assert.FileExists(t, j.QualifyOutput(src, "good.jsonnet.yml"))
+
+	// without it, the first failure stops the run
+	j.KeepGoing = false
+	err = j.Run(context.Background(), src)
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &errs))
+}
+
+func TestProcessKustomization_Cycle(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a", "kustomization.yml"), "resources:\n- ../b\n")
+	writeFile(t, filepath.Join(src, "b", "kustomization.yml"), "resources:\n- ../a\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	err := processKustomization(context.Background(), &j, nil, src, "a")
+	if assert.Error(t, err) {
+		resolved, _ := filepath.EvalSymlinks(src)
+		a, b := filepath.Join(resolved, "a"), filepath.Join(resolved, "b")
+		assert.Contains(t, err.Error(), "cycle detected: "+a+" -> "+b+" -> "+a)
+	}
+}
+
+func TestProcessKustomization_DryRun(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n- b.yml\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "b.yml"), `{}`)
+
+	out := filepath.Join(t.TempDir(), "out")
+	j := Jsonnetizer{Base: src, Output: out, DryRun: true}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	assert.Empty(t, invocations())
+	_, err := os.Stat(out)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []string{
+		"copy\t" + filepath.Join(src, "b.yml") + "\t" + j.QualifyOutput(src, "b.yml"),
+		"jsonnet\t" + filepath.Join(src, "a.jsonnet") + "\t" + j.QualifyOutput(src, "a.jsonnet.yml") + "\tjsonnet " + filepath.Join(src, "a.jsonnet"),
+		"write\t" + j.QualifyOutput(src, "kustomization.yml"),
+	}, j.Actions())
+}
+
+func TestJsonnetizer_Run_DryRunRoots(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	for _, root := range []string{"a", "b"} {
+		writeFile(t, filepath.Join(src, root, "kustomization.yml"), "resources:\n- "+root+".yml\n")
+		writeFile(t, filepath.Join(src, root, root+".yml"), `{}`)
+	}
+
+	// each run only has its own root's actions
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), DryRun: true}
+	for _, root := range []string{"a", "b"} {
+		kustRoot := filepath.Join(src, root)
+		assert.NoError(t, j.Run(context.Background(), kustRoot))
+		assert.Equal(t, []string{
+			"copy\t" + filepath.Join(kustRoot, root+".yml") + "\t" + j.QualifyOutput(kustRoot, root+".yml"),
+			"write\t" + j.QualifyOutput(kustRoot, "kustomization.yml"),
+		}, j.Actions(), root)
+	}
+}
+
+func TestProcessKustomization_RoundTrip(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	original := `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+commonLabels:
+  version: 1.10
+  build: "007"
+resources:
+- deploy.jsonnet
+patches:
+- path: replicas.jsonnet
+  target:
+    kind: Deployment
+    labelSelector: app=foo
+- target:
+    kind: Service
+  patch: |-
+    - op: replace
+      path: /spec/ports/0/port
+      value: 8080
+configMapGenerator:
+- name: settings
+  literals:
+  - PORT=8080
+  - ENABLED=yes
+  options:
+    disableNameSuffixHash: true
+`
+	writeFile(t, filepath.Join(src, "kustomization.yml"), original)
+	writeFile(t, filepath.Join(src, "deploy.jsonnet"), `{"kind": "Deployment"}`)
+	writeFile(t, filepath.Join(src, "replicas.jsonnet"), `{"spec": {"replicas": 2}}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	bytes, err := ioutil.ReadFile(j.QualifyOutput(src, "kustomization.yml"))
+	assert.NoError(t, err)
+	expected := strings.NewReplacer("deploy.jsonnet", "deploy.jsonnet.yml", "replicas.jsonnet", "replicas.jsonnet.yml").Replace(original)
+	assert.Equal(t, expected, string(bytes))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, map[string]string{"version": "1.10", "build": "007"}, kustomization.CommonLabels)
+	assert.Equal(t, []string{"PORT=8080", "ENABLED=yes"}, kustomization.ConfigMapGenerator[0].LiteralSources)
+	assert.Equal(t, "Service", kustomization.Patches[1].Target.Kind)
+}
+
+func TestProcessKustomization_GeneratorSources(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `configMapGenerator:
+- name: config
+  files:
+  - settings.jsonnet
+  - custom=app.conf
+  - key=rendered.jsonnet
+  - dir
+  envs:
+  - vars.env
+secretGenerator:
+- name: secret
+  files:
+  - token.txt
+`)
+	for _, name := range []string{"settings.jsonnet", "app.conf", "rendered.jsonnet", "dir/a.txt", "dir/b.txt", "vars.env", "token.txt"} {
+		writeFile(t, filepath.Join(src, name), `{}`)
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, []string{"settings.jsonnet=settings.jsonnet.yml", "custom=app.conf", "key=rendered.jsonnet.yml", "dir"}, kustomization.ConfigMapGenerator[0].FileSources)
+	assert.Equal(t, []string{"vars.env"}, kustomization.ConfigMapGenerator[0].EnvSources)
+	assert.Equal(t, []string{"token.txt"}, kustomization.SecretGenerator[0].FileSources)
+	for _, name := range []string{"settings.jsonnet.yml", "app.conf", "rendered.jsonnet.yml", "dir/a.txt", "dir/b.txt", "vars.env", "token.txt"} {
+		assert.FileExists(t, j.QualifyOutput(src, name))
+	}
+}
+
+func TestProcessKustomization_GeneratorSourceGlobs(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `configMapGenerator:
+- name: config
+  files:
+  - conf/*.jsonnet
+  - key=one/*.txt
+  - app.conf
+`)
+	for _, name := range []string{"conf/a.jsonnet", "conf/b.jsonnet", "one/only.txt", "app.conf"} {
+		writeFile(t, filepath.Join(src, name), `{}`)
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, []string{"a.jsonnet=conf/a.jsonnet.yml", "b.jsonnet=conf/b.jsonnet.yml", "key=one/only.txt", "app.conf"}, kustomization.ConfigMapGenerator[0].FileSources)
+	tree := j.Tree()
+	assert.Equal(t, TreePaths{Original: []string{"conf/*.jsonnet", "one/*.txt", "app.conf"}, Rewritten: []string{"conf/a.jsonnet.yml", "conf/b.jsonnet.yml", "one/only.txt", "app.conf"}}, tree.Sources)
+
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "configMapGenerator:\n- name: config\n  files:\n  - cfg=conf/*.jsonnet\n")
+	j = Jsonnetizer{Base: src, Output: t.TempDir()}
+	err := processKustomization(context.Background(), &j, nil, src, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "pattern given key cfg matches 2 files")
+	}
+}
+
+func TestProcessKustomization_PluginDirectories(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `generators:
+- generator.jsonnet
+- plugins
+transformers:
+- configs
+`)
+	writeFile(t, filepath.Join(src, "generator.jsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "plugins", "kustomization.yml"), `resources:
+- labels.jsonnet
+`)
+	writeFile(t, filepath.Join(src, "plugins", "labels.jsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "configs", "prefix.yml"), `{}`)
+	writeFile(t, filepath.Join(src, "configs", "nested", "suffix.yml"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, []string{"generator.jsonnet.yml", "plugins"}, kustomization.Generators)
+	assert.Equal(t, []string{"configs"}, kustomization.Transformers)
+
+	plugins := readKustomization(t, j.QualifyOutput(src, "plugins/kustomization.yml"))
+	assert.Equal(t, []string{"labels.jsonnet.yml"}, plugins.Resources)
+	for _, name := range []string{"generator.jsonnet.yml", "plugins/labels.jsonnet.yml", "configs/prefix.yml", "configs/nested/suffix.yml"} {
+		assert.FileExists(t, j.QualifyOutput(src, name))
+	}
+}
+
+func TestProcessKustomization_Escape(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "app", "kustomization.yml"), "resources:\n- ../base\n- ../shared/cm.jsonnet\n")
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources: []\n")
+	writeFile(t, filepath.Join(src, "shared", "cm.jsonnet"), `{}`)
+	root := filepath.Join(src, "app")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	err := processKustomization(context.Background(), &j, nil, root, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "../shared/cm.jsonnet is outside the kustomization root "+root)
+	_, err = os.Stat(j.QualifyOutput(src, "shared/cm.jsonnet.yml"))
+	assert.True(t, os.IsNotExist(err))
+
+	// other kustomizations, like ../base, may always be referred to
+	j = Jsonnetizer{Base: src, Output: t.TempDir(), AllowEscape: true}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, root, ""))
+	assert.Equal(t, []string{"../base", "../shared/cm.jsonnet.yml"}, readKustomization(t, j.QualifyOutput(root, "kustomization.yml")).Resources)
+	assert.FileExists(t, j.QualifyOutput(src, "shared/cm.jsonnet.yml"))
+}
+
+func TestProcessKustomization_ErrorContext(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- base\n")
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- ok.jsonnet\n- broken.jsonnet\n")
+	writeFile(t, filepath.Join(src, "base", "ok.jsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "base", "broken.jsonnet"), `error "boom"`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	err := processKustomization(context.Background(), &j, nil, src, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), fmt.Sprintf(`processing resource "base" under %q`, src))
+		assert.Contains(t, err.Error(), fmt.Sprintf(`processing resource "broken.jsonnet" under %q`, filepath.Join(src, "base")))
+	}
+}
+
+func TestProcessKustomization_Validate(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- good.jsonnet\n- plain.yml\ngenerators:\n- gen.jsonnet\n")
+	writeFile(t, filepath.Join(src, "good.jsonnet"), `{"apiVersion": "v1", "kind": "ConfigMap"}`)
+	writeFile(t, filepath.Join(src, "plain.yml"), `{}`)
+	writeFile(t, filepath.Join(src, "gen.jsonnet"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), Validate: true}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	writeFile(t, filepath.Join(src, "good.jsonnet"), `{"kind": "ConfigMap"}`)
+	err := j.Run(context.Background(), src)
+	assert.EqualError(t, err, fmt.Sprintf(`processing resource "good.jsonnet" under %q: output document 0 isn't a Kubernetes resource: missing apiVersion`, src))
+}
+
+func TestProcessKustomization_StripJsonnetExt(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n- list.jsonnet\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "list.jsonnet"), `[{"kind": "B"}, {"kind": "C"}]`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), StripJsonnetExt: true, Multi: true}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+	assert.Equal(t, []string{"a.yml", "list.0.yml", "list.1.yml"}, readKustomization(t, j.QualifyOutput(src, "kustomization.yml")).Resources)
+	assert.FileExists(t, j.QualifyOutput(src, "a.yml"))
+
+	writeFile(t, filepath.Join(src, "a.yml"), `{}`)
+	err := processKustomization(context.Background(), &j, nil, src, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "output of a.jsonnet would replace a.yml")
+	}
+}
+
+func TestProcessKustomization_RemoteResources(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- github.com/org/repo//overlay?ref=v1\n- https://example.com/deploy.yml\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, []string{"github.com/org/repo//overlay?ref=v1", "https://example.com/deploy.yml"}, kustomization.Resources)
+}
+
+func TestProcessKustomization_Globs(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- configs/*\n- ns.yml\n")
+	writeFile(t, filepath.Join(src, "configs", "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "configs", "b.yml"), "kind: B\n")
+	writeFile(t, filepath.Join(src, "ns.yml"), "kind: Namespace\n")
+
+	// preflight counts a pattern matching anything as present
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	kustomization := readKustomization(t, j.QualifyOutput(src, "kustomization.yml"))
+	assert.Equal(t, []string{"configs/a.jsonnet.yml", "configs/b.yml", "ns.yml"}, kustomization.Resources)
+	assert.FileExists(t, j.QualifyOutput(src, "configs/a.jsonnet.yml"))
+	assert.FileExists(t, j.QualifyOutput(src, "configs/b.yml"))
+
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- missing/*.yml\n")
+	err := j.Run(context.Background(), src)
+	assert.EqualError(t, err, "missing referenced files:\n  "+filepath.Join(src, "missing/*.yml"))
+	err = processKustomization(context.Background(), &j, nil, src, "")
+	assert.EqualError(t, err, fmt.Sprintf("processing resource %q under %q: pattern matches no files", "missing/*.yml", src))
+}
@@ -0,0 +1,213 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rootPlaceholder stands for the root to build in KustomizeArgs.
+const rootPlaceholder = "{{root}}"
+
+// ParseKustomizeArgs splits s on spaces into KustomizeArgs, which must stand
+// for the root somewhere.
+func ParseKustomizeArgs(s string) ([]string, error) {
+	args := strings.Fields(s)
+	return args, checkKustomizeArgs(args)
+}
+
+// checkKustomizeArgs returns a ConfigError should args, if any, not contain
+// rootPlaceholder, as nothing would be built without the root.
+func checkKustomizeArgs(args []string) error {
+	if len(args) > 0 && !strings.Contains(strings.Join(args, " "), rootPlaceholder) {
+		return &ConfigError{fmt.Errorf("kustomize args %q don't contain %s", strings.Join(args, " "), rootPlaceholder)}
+	}
+	return nil
+}
+
+func (j *Jsonnetizer) kustomizeArgs(root string) []string {
+	command := j.KustomizeCmd
+	if len(command) == 0 {
+		command = []string{"kustomize"}
+	}
+	if len(j.KustomizeArgs) > 0 {
+		args := []string{command[0]}
+		for _, arg := range j.KustomizeArgs {
+			args = append(args, strings.ReplaceAll(arg, rootPlaceholder, root))
+		}
+		return args
+	}
+	// a bare binary needs the build subcommand; anything longer (e.g.
+	// "kubectl kustomize") is expected to name its own
+	if len(command) == 1 {
+		command = append(command, "build")
+	}
+	args := append([]string{}, command...)
+	if j.AlphaPluginsFlag != "" {
+		args = append(args, j.AlphaPluginsFlag)
+	}
+	if j.AllowEscape {
+		// files outside the root stay outside it in the output, where
+		// kustomize would refuse them in turn
+		args = append(args, "--load-restrictor=LoadRestrictionsNone")
+	}
+	args = append(args, j.KustomizeFlags...)
+	return append(args, root)
+}
+
+var kustomizeVersionPattern = regexp.MustCompile(`\bv(\d+)\.\d+`)
+
+// DetectAlphaPluginsFlag works out which spelling of the alpha plugins flag
+// command understands: kustomize v4 renamed --enable_alpha_plugins to
+// --enable-alpha-plugins, which is also the only one kubectl kustomize has.
+func DetectAlphaPluginsFlag(l *Logger, command []string) string {
+	const legacy, current = "--enable_alpha_plugins", "--enable-alpha-plugins"
+	if len(command) > 1 {
+		return current
+	}
+
+	out, err := exec.Command(command[0], "version").Output()
+	if err != nil {
+		l.Warnf("Couldn't determine the kustomize version, assuming %s: %v", legacy, err)
+		return legacy
+	}
+	match := kustomizeVersionPattern.FindSubmatch(out)
+	if match == nil {
+		return legacy
+	}
+	major, err := strconv.Atoi(string(match[1]))
+	if err != nil || major < 4 {
+		return legacy
+	}
+	return current
+}
+
+// kustomizeRetryDelay is how long runKustomize waits before its first retry,
+// doubling before each one after.
+var kustomizeRetryDelay = time.Second
+
+// kustomizeInputErrorPattern matches the stderr of builds failing because of
+// their input, which no retry will fix.
+var kustomizeInputErrorPattern = regexp.MustCompile(`(?i)yaml:|json:|unmarshal|invalid|unknown field|no such file or directory|must build at directory|no matches for|already registered|is not in or below|security; file`)
+
+// runKustomize builds root, writing the output to BuildOutput. The output is
+// only written once a build succeeds, so diagnostics always come before the
+// output they preceded.
+func runKustomize(ctx context.Context, j *Jsonnetizer, root string) error {
+	out, err := kustomizeOutput(ctx, j, root)
+	if err != nil {
+		return err
+	}
+	return j.writeBuildOutput(out)
+}
+
+// kustomizeOutput builds root, retrying up to Retries times should kustomize
+// fail for what look like transient reasons, and returns the build output.
+// What each attempt wrote to stderr is logged once it exits.
+func kustomizeOutput(ctx context.Context, j *Jsonnetizer, root string) ([]byte, error) {
+	// a value on its own would be taken for the root, or take it as its own
+	for _, flag := range j.KustomizeFlags {
+		if !strings.HasPrefix(flag, "-") {
+			return nil, &ConfigError{fmt.Errorf("kustomize flag %q isn't a flag; give values as --flag=value", flag)}
+		}
+	}
+	err := checkKustomizeArgs(j.KustomizeArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	delay := kustomizeRetryDelay
+	for attempt := 1; ; attempt++ {
+		var stderr []byte
+		out, stderr, err = buildKustomization(ctx, j, root)
+		if len(stderr) > 0 {
+			j.logger().Warnf("%s", stderr)
+		}
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if attempt > j.Retries || !errors.As(err, &exitErr) || kustomizeInputErrorPattern.Match(stderr) {
+			return nil, &KustomizeError{Root: root, Err: err}
+		}
+
+		j.logger().Warnf("kustomize build failed, retrying in %s (%d of %d): %v", delay, attempt, j.Retries, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return out, nil
+}
+
+// writeBuildOutput writes outs, the output of one build each, to BuildOutput,
+// replacing what it held, or to stdout. They're written as one YAML stream.
+func (j *Jsonnetizer) writeBuildOutput(outs ...[]byte) error {
+	var stream bytes.Buffer
+	for _, out := range outs {
+		if stream.Len() > 0 && len(out) > 0 {
+			stream.WriteString("---\n")
+		}
+		stream.Write(out)
+	}
+
+	if j.BuildOutput == "" {
+		_, err := os.Stdout.Write(stream.Bytes())
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(j.BuildOutput), j.dirMode())
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(j.BuildOutput, stream.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't write build output: %w", err)
+	}
+	return nil
+}
+
+// buildKustomization runs kustomize build once, returning what it wrote to
+// stdout and stderr. Both are read as they're written, so kustomize can't
+// block on either filling up however much it writes to the other.
+func buildKustomization(ctx context.Context, j *Jsonnetizer, root string) ([]byte, []byte, error) {
+	args := j.kustomizeArgs(root)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = j.kustomizeEnv()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// kustomizeEnv returns the environment kustomize runs in: this process's,
+// with Env overriding it.
+func (j *Jsonnetizer) kustomizeEnv() []string {
+	env := os.Environ()
+	var keys []string
+	for key := range j.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// later entries take precedence
+	for _, key := range keys {
+		env = append(env, key+"="+j.Env[key])
+	}
+	return env
+}
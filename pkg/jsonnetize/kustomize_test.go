@@ -0,0 +1,261 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunKustomize_Command(t *testing.T) {
+	bin, invocations := fakeBin(t, "kustomize", fakeKustomizeScript)
+
+	j := Jsonnetizer{AlphaPluginsFlag: "--enable_alpha_plugins"}
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+
+	// the subcommand is passed through for commands like "kubectl kustomize"
+	j.KustomizeCmd = []string{bin, "kustomize"}
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+
+	j.AlphaPluginsFlag = ""
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+
+	j.AllowEscape = true
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+
+	j.AllowEscape = false
+	j.KustomizeFlags = []string{"--reorder=none", "--load-restrictor=LoadRestrictionsNone"}
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+
+	// values must be given with their flag, leaving the root last
+	j.KustomizeFlags = []string{"--reorder", "none"}
+	var configErr *ConfigError
+	assert.True(t, errors.As(runKustomize(context.Background(), &j, "root"), &configErr))
+
+	assert.Equal(t, []string{
+		"build --enable_alpha_plugins root",
+		"kustomize --enable_alpha_plugins root",
+		"kustomize root",
+		"kustomize --load-restrictor=LoadRestrictionsNone root",
+		"kustomize --reorder=none --load-restrictor=LoadRestrictionsNone root",
+	}, invocations())
+}
+
+func TestRunKustomize_Args(t *testing.T) {
+	bin, invocations := fakeBin(t, "kustomize", fakeKustomizeScript)
+
+	// the template replaces everything after the binary
+	j := Jsonnetizer{
+		KustomizeCmd:     []string{bin, "kustomize"},
+		AlphaPluginsFlag: "--enable_alpha_plugins",
+		KustomizeFlags:   []string{"--reorder=none"},
+		KustomizeArgs:    []string{"build", "--output={{root}}/all.yml", "{{root}}"},
+	}
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+	assert.Equal(t, []string{"build --output=root/all.yml root"}, invocations())
+
+	j.KustomizeArgs = []string{"build", "--reorder=none"}
+	var configErr *ConfigError
+	err := runKustomize(context.Background(), &j, "root")
+	assert.True(t, errors.As(err, &configErr), "%v", err)
+	assert.EqualError(t, err, `kustomize args "build --reorder=none" don't contain {{root}}`)
+	assert.Len(t, invocations(), 1)
+}
+
+func TestParseKustomizeArgs(t *testing.T) {
+	args, err := ParseKustomizeArgs(" build  --reorder=none {{root}}")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build", "--reorder=none", "{{root}}"}, args)
+
+	args, err = ParseKustomizeArgs("")
+	assert.NoError(t, err)
+	assert.Empty(t, args)
+
+	var configErr *ConfigError
+	_, err = ParseKustomizeArgs("build --reorder=none")
+	assert.True(t, errors.As(err, &configErr), "%v", err)
+	assert.EqualError(t, err, `kustomize args "build --reorder=none" don't contain {{root}}`)
+}
+
+func TestDetectAlphaPluginsFlag(t *testing.T) {
+	for version, expected := range map[string]string{
+		"{Version:kustomize/v3.8.1 GitCommit:0b359d0ef}":  "--enable_alpha_plugins",
+		"{Version:kustomize/v4.5.7 GitCommit:56d82a8378}": "--enable-alpha-plugins",
+		"v5.0.1":  "--enable-alpha-plugins",
+		"unknown": "--enable_alpha_plugins",
+	} {
+		bin, _ := fakeBin(t, "kustomize", "#!/bin/sh\necho '"+version+"'\n")
+		assert.Equal(t, expected, DetectAlphaPluginsFlag(defaultLogger, []string{bin}), version)
+	}
+
+	assert.Equal(t, "--enable-alpha-plugins", DetectAlphaPluginsFlag(defaultLogger, []string{"kubectl", "kustomize"}))
+}
+
+func TestRunKustomize_BuildOutput(t *testing.T) {
+	fakeBin(t, "kustomize", "#!/bin/sh\necho 'kind: Namespace'\n")
+
+	output := filepath.Join(t.TempDir(), "nested", "manifests.yml")
+	j := Jsonnetizer{BuildOutput: output}
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+
+	bytes, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: Namespace\n", string(bytes))
+}
+
+func TestRunKustomize_Retries(t *testing.T) {
+	delay := kustomizeRetryDelay
+	kustomizeRetryDelay = time.Millisecond
+	defer func() { kustomizeRetryDelay = delay }()
+
+	// fails until it has been run $FAIL_TIMES times, with $FAIL_MESSAGE
+	_, invocations := fakeBin(t, "kustomize", `#!/bin/sh
+echo "$*" >> "$FAKE_KUSTOMIZE_LOG"
+if [ "$(wc -l < "$FAKE_KUSTOMIZE_LOG")" -le "$FAIL_TIMES" ]; then
+	echo "partial"
+	echo "$FAIL_MESSAGE" >&2
+	exit 1
+fi
+echo 'kind: Namespace'
+`)
+	setenv(t, "FAIL_MESSAGE", "Error: fork/exec plugin: resource temporarily unavailable")
+	setenv(t, "FAIL_TIMES", "2")
+
+	output := filepath.Join(t.TempDir(), "manifests.yml")
+	j := Jsonnetizer{BuildOutput: output, Retries: 2}
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+	assert.Len(t, invocations(), 3)
+	// failed attempts leave nothing in the output
+	bytes, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: Namespace\n", string(bytes))
+
+	// out of retries
+	setenv(t, "FAIL_TIMES", "6")
+	assert.Error(t, runKustomize(context.Background(), &j, "root"))
+	assert.Len(t, invocations(), 6)
+
+	// a broken kustomization fails the same way every time
+	setenv(t, "FAIL_TIMES", "100")
+	setenv(t, "FAIL_MESSAGE", "Error: map[string]interface {}(nil): yaml: unmarshal errors")
+	assert.Error(t, runKustomize(context.Background(), &j, "root"))
+	assert.Len(t, invocations(), 7)
+}
+
+func TestRunKustomize_LargeOutput(t *testing.T) {
+	// enough of each to fill a pipe many times over, interleaved
+	fakeBin(t, "kustomize", `#!/bin/sh
+i=0
+while [ $i -lt 5000 ]; do
+	echo "kind: Resource$i # padding padding padding padding padding"
+	echo "warning: resource $i is deprecated, padding padding padding" >&2
+	i=$((i+1))
+done
+`)
+	var log bytes.Buffer
+	output := filepath.Join(t.TempDir(), "manifests.yml")
+	j := Jsonnetizer{BuildOutput: output, Log: NewLogger(&log, false)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	assert.NoError(t, runKustomize(ctx, &j, "root"))
+
+	out, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if assert.Len(t, lines, 5000) {
+		assert.Equal(t, "kind: Resource0 # padding padding padding padding padding", lines[0])
+		assert.Equal(t, "kind: Resource4999 # padding padding padding padding padding", lines[4999])
+	}
+	// stderr is logged whole and in order
+	first := strings.Index(log.String(), "warning: resource 0 is")
+	last := strings.Index(log.String(), "warning: resource 4999 is")
+	assert.True(t, first >= 0 && last > first)
+	assert.Equal(t, 5000, strings.Count(log.String(), "is deprecated"))
+}
+
+func TestRunKustomize_Env(t *testing.T) {
+	fakeBin(t, "kustomize", "#!/bin/sh\necho \"$KUSTOMIZE_PLUGIN_HOME $JSONNETIZE_TEST_INHERITED\"\n")
+	setenv(t, "KUSTOMIZE_PLUGIN_HOME", "/from/parent")
+	setenv(t, "JSONNETIZE_TEST_INHERITED", "inherited")
+
+	output := filepath.Join(t.TempDir(), "manifests.yml")
+	j := Jsonnetizer{BuildOutput: output, Env: map[string]string{"KUSTOMIZE_PLUGIN_HOME": "/plugins"}}
+	assert.NoError(t, runKustomize(context.Background(), &j, "root"))
+
+	bytes, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "/plugins inherited\n", string(bytes))
+}
+
+func TestJsonnetizer_BuildRoots(t *testing.T) {
+	// each build counts those running alongside it by the files they hold
+	running := t.TempDir()
+	setenv(t, "FAKE_KUSTOMIZE_RUNNING", running)
+	_, invocations := fakeBin(t, "kustomize", `#!/bin/sh
+for root; do :; done
+touch "$FAKE_KUSTOMIZE_RUNNING/$$"
+ls "$FAKE_KUSTOMIZE_RUNNING" | wc -l | tr -d ' ' >> "$FAKE_KUSTOMIZE_LOG"
+sleep 0.1
+rm "$FAKE_KUSTOMIZE_RUNNING/$$"
+case "$root" in */fail) exit 1;; esac
+echo "root: ${root##*/}"
+`)
+	src := t.TempDir()
+	var roots []string
+	for _, root := range []string{"a", "b", "c", "d", "e"} {
+		roots = append(roots, filepath.Join(src, root))
+	}
+
+	for concurrency, expected := range map[int]int{0: 1, 1: 1, 2: 2, 3: 3} {
+		os.Remove(os.Getenv("FAKE_KUSTOMIZE_LOG"))
+		j := Jsonnetizer{Output: t.TempDir(), BuildOutput: filepath.Join(t.TempDir(), "out.yml"), BuildConcurrency: concurrency}
+		assert.Equal(t, make([]error, len(roots)), j.BuildRoots(context.Background(), roots), concurrency)
+
+		// whichever finished first, the output is in the order of the roots
+		data, err := ioutil.ReadFile(j.BuildOutput)
+		assert.NoError(t, err)
+		assert.Equal(t, "root: a\n---\nroot: b\n---\nroot: c\n---\nroot: d\n---\nroot: e\n", string(data), concurrency)
+
+		counts := invocations()
+		assert.Len(t, counts, len(roots), concurrency)
+		max := 0
+		for _, count := range counts {
+			n, err := strconv.Atoi(count)
+			assert.NoError(t, err)
+			if n > max {
+				max = n
+			}
+		}
+		assert.Equal(t, expected, max, "builds at once with a concurrency of %d", concurrency)
+	}
+
+	// a failure stops the builds still to start, unless told to keep going
+	failing := []string{filepath.Join(src, "fail"), filepath.Join(src, "a")}
+	for _, keepGoing := range []bool{false, true} {
+		os.Remove(os.Getenv("FAKE_KUSTOMIZE_LOG"))
+		j := Jsonnetizer{Output: t.TempDir(), BuildOutput: filepath.Join(t.TempDir(), "out.yml"), KeepGoing: keepGoing}
+		errs := j.BuildRoots(context.Background(), failing)
+		var kustomizeErr *KustomizeError
+		assert.True(t, errors.As(errs[0], &kustomizeErr), "%v", errs[0])
+		assert.Nil(t, errs[1])
+		if keepGoing {
+			assert.Len(t, invocations(), 2)
+			data, err := ioutil.ReadFile(j.BuildOutput)
+			assert.NoError(t, err)
+			assert.Equal(t, "root: a\n", string(data))
+		} else {
+			assert.Len(t, invocations(), 1)
+			_, err := os.Stat(j.BuildOutput)
+			assert.True(t, os.IsNotExist(err), "nothing was built")
+		}
+	}
+}
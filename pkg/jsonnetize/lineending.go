@@ -0,0 +1,66 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// LineEnding is how the line endings of text files are written to the output
+// tree.
+type LineEnding string
+
+const (
+	// LineEndingLF writes every line ending as \n.
+	LineEndingLF LineEnding = "lf"
+	// LineEndingCRLF writes every line ending as \r\n.
+	LineEndingCRLF LineEnding = "crlf"
+	// LineEndingKeep writes line endings as they are.
+	LineEndingKeep LineEnding = "keep"
+)
+
+var lineEndings = []LineEnding{LineEndingLF, LineEndingCRLF, LineEndingKeep}
+
+// ParseLineEnding returns the LineEnding named s.
+func ParseLineEnding(s string) (LineEnding, error) {
+	for _, lineEnding := range lineEndings {
+		if string(lineEnding) == s {
+			return lineEnding, nil
+		}
+	}
+
+	var names []string
+	for _, lineEnding := range lineEndings {
+		names = append(names, string(lineEnding))
+	}
+	return "", &ConfigError{fmt.Errorf("unknown line ending %q; must be one of %s", s, strings.Join(names, ", "))}
+}
+
+func (j *Jsonnetizer) lineEnding() LineEnding {
+	if j.LineEnding == "" {
+		return LineEndingLF
+	}
+	return j.LineEnding
+}
+
+// isBinary sniffs data for a NUL byte near its start, as git does.
+func isBinary(data []byte) bool {
+	const sniffLen = 8000
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// normalizeLineEndings returns data with its line endings written as
+// lineEnding has them. Binary data is returned as it is.
+func normalizeLineEndings(data []byte, lineEnding LineEnding) []byte {
+	if lineEnding == LineEndingKeep || isBinary(data) {
+		return data
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if lineEnding == LineEndingCRLF {
+		data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	}
+	return data
+}
@@ -0,0 +1,49 @@
+package jsonnetize
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLineEnding(t *testing.T) {
+	lineEnding, err := ParseLineEnding("crlf")
+	assert.NoError(t, err)
+	assert.Equal(t, LineEndingCRLF, lineEnding)
+
+	_, err = ParseLineEnding("cr")
+	assert.EqualError(t, err, `unknown line ending "cr"; must be one of lf, crlf, keep`)
+}
+
+func TestProcessKustomization_LineEndings(t *testing.T) {
+	// a jsonnet whose output has CRLF line endings, as on Windows
+	fakeBin(t, "jsonnet", "#!/bin/sh\nprintf '{\\r\\n  \"kind\": \"A\"\\r\\n}\\r\\n'\n")
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n- mixed.yml\n- data.bin\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"kind": "A"}`)
+	writeFile(t, filepath.Join(src, "mixed.yml"), "kind: B\r\nmetadata:\n  name: b\r\n")
+	binary := "\x00\r\n\x01\n"
+	writeFile(t, filepath.Join(src, "data.bin"), binary)
+
+	for lineEnding, expected := range map[LineEnding][2]string{
+		"":             {"kind: A\n", "kind: B\nmetadata:\n  name: b\n"},
+		LineEndingLF:   {"kind: A\n", "kind: B\nmetadata:\n  name: b\n"},
+		LineEndingCRLF: {"kind: A\r\n", "kind: B\r\nmetadata:\r\n  name: b\r\n"},
+		LineEndingKeep: {"kind: A\n", "kind: B\r\nmetadata:\n  name: b\r\n"},
+	} {
+		j := Jsonnetizer{Base: src, Output: t.TempDir(), LineEnding: lineEnding}
+		assert.NoError(t, j.Run(context.Background(), src))
+
+		for i, path := range []string{"a.jsonnet.yml", "mixed.yml"} {
+			out, err := ioutil.ReadFile(j.QualifyOutput(src, path))
+			assert.NoError(t, err)
+			assert.Equal(t, expected[i], string(out), "%s %s", lineEnding, path)
+		}
+		out, err := ioutil.ReadFile(j.QualifyOutput(src, "data.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, binary, string(out), lineEnding)
+	}
+}
@@ -0,0 +1,34 @@
+package jsonnetize
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// Logger is a small leveled logger. Debug messages are dropped unless
+// Verbose is set; everything else is always written.
+type Logger struct {
+	Verbose bool
+	out     *log.Logger
+}
+
+func NewLogger(w io.Writer, verbose bool) *Logger {
+	return &Logger{Verbose: verbose, out: log.New(w, "", log.LstdFlags)}
+}
+
+var defaultLogger = NewLogger(os.Stderr, false)
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	if l.Verbose {
+		l.out.Printf(format, v...)
+	}
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.out.Printf(format, v...)
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.out.Printf("warning: "+format, v...)
+}
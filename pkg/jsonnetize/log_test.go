@@ -0,0 +1,36 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, false)
+	l.Debugf("hidden %d", 1)
+	l.Warnf("shown %d", 2)
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "warning: shown 2")
+
+	l.Verbose = true
+	l.Debugf("detail %d", 3)
+	assert.Contains(t, buf.String(), "detail 3")
+}
+
+func TestProcessFileRef_Logging(t *testing.T) {
+	var buf bytes.Buffer
+	j := Jsonnetizer{Log: NewLogger(&buf, false)}
+
+	_, err := processFileRef(context.Background(), &j, "", "https://example.com/remote.yml")
+	assert.NoError(t, err)
+	assert.Empty(t, buf.String())
+
+	j.Log.Verbose = true
+	_, err = processFileRef(context.Background(), &j, "", "https://example.com/remote.yml")
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "https://example.com/remote.yml is not a local file; leaving it alone")
+}
@@ -0,0 +1,111 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemFS is an FS holding the output tree in memory, for embedding jsonnetize
+// where nothing is to be written to disk. File permissions aren't kept. Its
+// zero value is empty and ready to use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+func (m *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+		}
+		if m.dirs == nil {
+			m.dirs = map[string]bool{}
+		}
+		m.dirs[dir] = true
+		if filepath.Dir(dir) == dir {
+			return nil
+		}
+	}
+}
+
+func (m *MemFS) WriteFile(name string, perm os.FileMode, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	err := write(&buf)
+	if err != nil {
+		return err
+	}
+
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[filepath.Dir(name)] {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if m.dirs[name] {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	if m.files == nil {
+		m.files = map[string][]byte{}
+	}
+	m.files[name] = buf.Bytes()
+	return nil
+}
+
+func (m *MemFS) Open(name string) (io.ReadCloser, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MemFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name := range m.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(m.files, name)
+		}
+	}
+	for dir := range m.dirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+// ReadFile returns the contents of the file name.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte{}, data...), nil
+}
+
+// Files returns the names of every file, sorted.
+func (m *MemFS) Files() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
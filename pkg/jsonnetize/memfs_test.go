@@ -0,0 +1,75 @@
+package jsonnetize
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonnetizer_Run_MemFS(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n- b.yml\n- base\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `{"apiVersion": "v1", "kind": "A"}`)
+	writeFile(t, filepath.Join(src, "b.yml"), "kind: B\n")
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- c.yml\n")
+	writeFile(t, filepath.Join(src, "base", "c.yml"), "kind: C\n")
+
+	out := t.TempDir()
+	var memFS MemFS
+	j := Jsonnetizer{Base: src, Output: out, FS: &memFS, Validate: true}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	assert.Equal(t, []string{
+		filepath.Join(out, "a.jsonnet.yml"),
+		filepath.Join(out, "b.yml"),
+		filepath.Join(out, "base", "c.yml"),
+		filepath.Join(out, "base", "kustomization.yml"),
+		filepath.Join(out, "kustomization.yml"),
+	}, memFS.Files())
+	data, err := memFS.ReadFile(j.QualifyOutput(src, "a.jsonnet.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "apiVersion: v1\nkind: A\n", string(data))
+	data, err = memFS.ReadFile(j.QualifyOutput(src, "kustomization.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "resources:\n- a.jsonnet.yml\n- b.yml\n- base\n", string(data))
+
+	entries, err := ioutil.ReadDir(out)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "nothing should be written to disk")
+
+	var configErr *ConfigError
+	assert.True(t, errors.As(j.Build(context.Background(), src), &configErr))
+
+	assert.NoError(t, j.Clean(src))
+	assert.Empty(t, memFS.Files())
+}
+
+func TestMemFS_WriteFile(t *testing.T) {
+	var memFS MemFS
+	write := func(w io.Writer) error { return nil }
+	assert.Error(t, memFS.WriteFile("/out/dir/f", 0644, write), "the directory must exist")
+
+	assert.NoError(t, memFS.MkdirAll("/out/dir", 0755))
+	assert.NoError(t, writeOutputFile(&Jsonnetizer{FS: &memFS}, "/out/dir/f", []byte("old")))
+	_, err := memFS.ReadFile("/out/dir/g")
+	assert.Error(t, err)
+	assert.Error(t, memFS.MkdirAll("/out/dir/f/sub", 0755))
+
+	// a failed write leaves the old contents
+	assert.Error(t, memFS.WriteFile("/out/dir/f", 0644, func(w io.Writer) error {
+		_, _ = w.Write([]byte("partial"))
+		return errors.New("killed")
+	}))
+	data, err := memFS.ReadFile("/out/dir/f")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	assert.NoError(t, memFS.RemoveAll("/out"))
+	assert.Empty(t, memFS.Files())
+}
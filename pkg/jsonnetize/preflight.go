@@ -0,0 +1,127 @@
+package jsonnetize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+// preflight checks that every local path the kustomization at root refers to,
+// and those of the kustomizations it refers to in turn, exists, so that a run
+// fails before writing anything rather than part way through. Every missing
+// path is listed in the one error. Kustomizations which can't be read are
+// left for processing to report.
+func preflight(root string) error {
+	var missing []string
+	preflightKustomization(root, map[string]bool{}, &missing)
+	if len(missing) > 0 {
+		return fmt.Errorf("missing referenced files:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+func preflightKustomization(root string, seen map[string]bool, missing *[]string) {
+	abs, err := filepath.Abs(root)
+	if err != nil || seen[abs] {
+		return
+	}
+	seen[abs] = true
+
+	kust, _, err := findKustFile(root)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadFile(kust)
+	if err != nil {
+		return
+	}
+	var kustomization kustomizationFile
+	if yaml.Unmarshal(data, &kustomization) != nil {
+		return
+	}
+
+	// check reports whether root/path exists, recording it if it doesn't
+	check := func(path string) (os.FileInfo, bool) {
+		if path == "" || !isLocalFile(path) {
+			return nil, false
+		}
+		si, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			*missing = append(*missing, filepath.Join(root, path))
+			return nil, false
+		}
+		return si, true
+	}
+	// expand returns paths with any glob patterns among them replaced by
+	// what they match, as processing does, recording those matching nothing
+	expand := func(kustType KustomizeType, paths []string) []string {
+		var expanded []string
+		for _, path := range paths {
+			matches, err := expandGlobs(root, kustType, []string{path})
+			if err != nil {
+				*missing = append(*missing, filepath.Join(root, path))
+				continue
+			}
+			expanded = append(expanded, matches...)
+		}
+		return expanded
+	}
+
+	for _, paths := range [][]string{kustomization.Resources, kustomization.Components, kustomization.Bases} {
+		for _, path := range expand(ResourceType, paths) {
+			if si, ok := check(path); ok && si.IsDir() {
+				if _, _, err := findKustFile(filepath.Join(root, path)); err != nil {
+					*missing = append(*missing, filepath.Join(root, path, kustFileNames[0]))
+					continue
+				}
+				preflightKustomization(filepath.Join(root, path), seen, missing)
+			}
+		}
+	}
+	for _, paths := range [][]string{kustomization.Generators, kustomization.Transformers} {
+		for _, path := range expand(PluginType, paths) {
+			// a plugin directory needn't be a kustomization
+			if si, ok := check(path); ok && si.IsDir() {
+				preflightKustomization(filepath.Join(root, path), seen, missing)
+			}
+		}
+	}
+
+	// only the lists processTypes walks may hold patterns
+	var files, patterns []string
+	for _, patch := range kustomization.Patches {
+		files = append(files, patch.Path)
+	}
+	for _, patch := range kustomization.PatchesStrategicMerge {
+		if !isInlinePatch(root, string(patch)) {
+			patterns = append(patterns, string(patch))
+		}
+	}
+	for _, patch := range kustomization.PatchesJson6902 {
+		files = append(files, patch.Path)
+	}
+	var sources []types.KvPairSources
+	for _, generator := range kustomization.ConfigMapGenerator {
+		sources = append(sources, generator.KvPairSources)
+	}
+	for _, generator := range kustomization.SecretGenerator {
+		sources = append(sources, generator.KvPairSources)
+	}
+	for _, source := range sources {
+		for _, file := range source.FileSources {
+			// strip any key= prefix
+			patterns = append(patterns, file[strings.Index(file, "=")+1:])
+		}
+		patterns = append(patterns, source.EnvSources...)
+	}
+	patterns = append(patterns, kustomization.Crds...)
+	files = append(files, kustomization.OpenAPI["path"])
+	for _, file := range append(files, expand(SourceType, patterns)...) {
+		check(file)
+	}
+}
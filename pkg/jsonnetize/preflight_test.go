@@ -0,0 +1,41 @@
+package jsonnetize
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonnetizer_Run_Preflight(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `resources:
+- present.jsonnet
+- missing.jsonnet
+- base
+- github.com/org/repo//overlay?ref=v1
+patchesStrategicMerge:
+- |-
+  kind: Deployment
+configMapGenerator:
+- name: config
+  files:
+  - key=settings.json
+`)
+	writeFile(t, filepath.Join(src, "present.jsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "settings.json"), `{}`)
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- gone.yml\n- ../base\n")
+
+	out := t.TempDir()
+	j := Jsonnetizer{Base: src, Output: out}
+	err := j.Run(context.Background(), src)
+	assert.EqualError(t, err, "missing referenced files:\n  "+filepath.Join(src, "missing.jsonnet")+"\n  "+filepath.Join(src, "base", "gone.yml"))
+
+	assert.Empty(t, invocations())
+	entries, err := ioutil.ReadDir(out)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "nothing should be written")
+}
@@ -0,0 +1,53 @@
+package jsonnetize
+
+import "sort"
+
+// The actions a ReportEntry can record.
+const (
+	ReportCompiled = "compiled"
+	ReportCopied   = "copied"
+	ReportSkipped  = "skipped"
+)
+
+// ReportEntry records what was done with one file a kustomization refers to.
+type ReportEntry struct {
+	// Root is the kustomization root the file belongs to.
+	Root string `json:"root"`
+	// Source is the file as the kustomization names it, or for imports,
+	// its resolved path.
+	Source string `json:"source"`
+	// Output is where the file was written to; skipped files have none.
+	Output string `json:"output,omitempty"`
+	Action string `json:"action"`
+	// Command is the jsonnet invocation compiling the file.
+	Command []string `json:"command,omitempty"`
+	// Cached is set when compiled output came from the cache.
+	Cached bool `json:"cached,omitempty"`
+	// Unchanged is set when compiled output was kept from an earlier run,
+	// nothing it was compiled from having changed since Since.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+func (j *Jsonnetizer) report(entry ReportEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.reports = append(j.reports, entry)
+}
+
+// Report returns what the last Run did with each file, sorted by root and
+// source so that it's stable regardless of processing order.
+func (j *Jsonnetizer) Report() []ReportEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := append([]ReportEntry{}, j.reports...)
+	sort.SliceStable(entries, func(a, b int) bool {
+		if entries[a].Root != entries[b].Root {
+			return entries[a].Root < entries[b].Root
+		}
+		if entries[a].Source != entries[b].Source {
+			return entries[a].Source < entries[b].Source
+		}
+		return entries[a].Output < entries[b].Output
+	})
+	return entries
+}
@@ -0,0 +1,28 @@
+package jsonnetize
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonnetizer_Report(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n- b.yml\n- https://example.com/remote.yml\n")
+	writeFile(t, filepath.Join(src, "a.jsonnet"), `import "lib.libsonnet"`)
+	writeFile(t, filepath.Join(src, "lib.libsonnet"), `{}`)
+	writeFile(t, filepath.Join(src, "b.yml"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	assert.Equal(t, []ReportEntry{
+		{Root: src, Source: filepath.Join(src, "lib.libsonnet"), Output: j.QualifyOutput(filepath.Join(src, "lib.libsonnet"), ""), Action: ReportCopied},
+		{Root: src, Source: "a.jsonnet", Output: j.QualifyOutput(src, "a.jsonnet.yml"), Action: ReportCompiled, Command: []string{"jsonnet", filepath.Join(src, "a.jsonnet")}},
+		{Root: src, Source: "b.yml", Output: j.QualifyOutput(src, "b.yml"), Action: ReportCopied},
+		{Root: src, Source: "https://example.com/remote.yml", Action: ReportSkipped},
+	}, j.Report())
+}
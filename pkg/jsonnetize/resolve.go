@@ -0,0 +1,112 @@
+package jsonnetize
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ResolveBin picks the binary named by the flag, then the env var, then def,
+// and checks that it can be found.
+func ResolveBin(flagValue, env, def string) (string, error) {
+	bin := flagValue
+	if bin == "" {
+		bin = os.Getenv(env)
+	}
+	if bin == "" {
+		bin = def
+	}
+
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return "", &ConfigError{fmt.Errorf("couldn't find %s; install it or set its location with the flag or %s: %w", bin, env, err)}
+	}
+	return path, nil
+}
+
+// ResolveCommand is ResolveBin for a command which may carry arguments, such
+// as "kubectl kustomize". Only the binary itself is looked up.
+func ResolveCommand(flagValue, env, def string) ([]string, error) {
+	value := flagValue
+	if value == "" {
+		value = os.Getenv(env)
+	}
+	command := strings.Fields(value)
+	if len(command) == 0 {
+		command = []string{def}
+	}
+
+	bin, err := ResolveBin(command[0], env, def)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{bin}, command[1:]...), nil
+}
+
+func ResolveJPaths(root string, jpaths []string) []string {
+	var resolved []string
+	for _, jpath := range jpaths {
+		if !filepath.IsAbs(jpath) {
+			jpath = filepath.Join(root, jpath)
+		}
+		resolved = append(resolved, jpath)
+	}
+	return resolved
+}
+
+// ResolveExtVars normalizes each var to key=value form; a bare key takes its
+// value from the environment, as the jsonnet CLI does.
+func ResolveExtVars(vars []string) ([]string, error) {
+	var resolved []string
+	for _, v := range vars {
+		if !strings.Contains(v, "=") {
+			value, ok := os.LookupEnv(v)
+			if !ok {
+				return nil, &ConfigError{fmt.Errorf("environment variable %s was undefined", v)}
+			}
+			v = v + "=" + value
+		}
+		if strings.HasPrefix(v, "=") {
+			return nil, &ConfigError{fmt.Errorf("missing variable name: %s", v)}
+		}
+		resolved = append(resolved, v)
+	}
+	return resolved, nil
+}
+
+// ResolveVarFiles checks that each var is in key=path form, naming a file
+// that exists, and makes its path absolute.
+func ResolveVarFiles(vars []string) ([]string, error) {
+	var resolved []string
+	for _, v := range vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, &ConfigError{fmt.Errorf("%s must be of the form key=path", v)}
+		}
+		path, err := filepath.Abs(parts[1])
+		if err != nil {
+			return nil, &ConfigError{err}
+		}
+		_, err = os.Stat(path)
+		if err != nil {
+			return nil, &ConfigError{fmt.Errorf("file of variable %s: %w", parts[0], err)}
+		}
+		resolved = append(resolved, parts[0]+"="+path)
+	}
+	return resolved, nil
+}
+
+// ParseEnv parses vars, each in KEY=VALUE form, into a map.
+func ParseEnv(vars []string) (map[string]string, error) {
+	env := map[string]string{}
+	for _, v := range vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, &ConfigError{fmt.Errorf("%s must be of the form KEY=VALUE", v)}
+		}
+		env[parts[0]] = parts[1]
+	}
+	return env, nil
+}
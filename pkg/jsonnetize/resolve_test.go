@@ -0,0 +1,91 @@
+package jsonnetize
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveJPaths(t *testing.T) {
+	assert.Equal(t, []string{"/root/vendor", "/lib"}, ResolveJPaths("/root", []string{"vendor", "/lib"}))
+}
+
+func TestResolveExtVars(t *testing.T) {
+	setenv(t, "JSONNETIZE_TEST_VAR", "from-env")
+
+	resolved, err := ResolveExtVars([]string{"a=b", "url=http://x?y=z", "JSONNETIZE_TEST_VAR"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a=b", "url=http://x?y=z", "JSONNETIZE_TEST_VAR=from-env"}, resolved)
+
+	_, err = ResolveExtVars([]string{"JSONNETIZE_TEST_UNDEFINED"})
+	assert.Error(t, err)
+
+	_, err = ResolveExtVars([]string{"=value"})
+	assert.Error(t, err)
+}
+
+func TestResolveVarFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ca.pem"), "-----BEGIN CERTIFICATE-----\n")
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	rel, err := filepath.Rel(wd, filepath.Join(dir, "ca.pem"))
+	assert.NoError(t, err)
+
+	// relative to the working directory
+	resolved, err := ResolveVarFiles([]string{"cert=" + rel})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cert=" + filepath.Join(dir, "ca.pem")}, resolved)
+
+	for _, v := range []string{"cert", "=ca.pem", "cert=", "cert=" + filepath.Join(dir, "missing.pem")} {
+		_, err = ResolveVarFiles([]string{v})
+		assert.Error(t, err, v)
+	}
+}
+
+func TestResolveBin(t *testing.T) {
+	bin := t.TempDir()
+	for _, name := range []string{"from-flag", "from-env", "default"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"), 0755))
+	}
+	setenv(t, "PATH", bin)
+
+	setenv(t, "JSONNETIZE_TEST_BIN", "from-env")
+	resolved, err := ResolveBin("from-flag", "JSONNETIZE_TEST_BIN", "default")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(bin, "from-flag"), resolved)
+
+	resolved, err = ResolveBin("", "JSONNETIZE_TEST_BIN", "default")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(bin, "from-env"), resolved)
+
+	setenv(t, "JSONNETIZE_TEST_BIN", "")
+	resolved, err = ResolveBin("", "JSONNETIZE_TEST_BIN", "default")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(bin, "default"), resolved)
+
+	_, err = ResolveBin("missing", "JSONNETIZE_TEST_BIN", "default")
+	assert.Error(t, err)
+}
+
+func TestResolveCommand(t *testing.T) {
+	bin, _ := fakeBin(t, "kubectl", "#!/bin/sh\n")
+
+	command, err := ResolveCommand("kubectl kustomize", "JSONNETIZE_TEST_BIN", "kustomize")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{bin, "kustomize"}, command)
+}
+
+func TestParseEnv(t *testing.T) {
+	env, err := ParseEnv([]string{"KUSTOMIZE_PLUGIN_HOME=/plugins", "EMPTY=", "URL=http://x?y=z"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"KUSTOMIZE_PLUGIN_HOME": "/plugins", "EMPTY": "", "URL": "http://x?y=z"}, env)
+
+	for _, v := range []string{"KEY", "=value"} {
+		_, err = ParseEnv([]string{v})
+		assert.Error(t, err, v)
+	}
+}
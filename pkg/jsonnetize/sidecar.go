@@ -0,0 +1,151 @@
+package jsonnetize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sidecarName is the file alongside a kustomization file giving individual
+// jsonnet files arguments of their own.
+const sidecarName = "jsonnetize.yaml"
+
+type sidecar struct {
+	// Files maps paths, relative to the kustomization root, to their
+	// arguments.
+	Files map[string]jsonnetVars `yaml:"files"`
+	// JsonnetBin overrides the jsonnet binary for the files under the
+	// kustomization root. A relative path is relative to the root.
+	JsonnetBin string `yaml:"jsonnetBin"`
+}
+
+// jsonnetVars are the variables a jsonnet file is evaluated with, each in
+// key=value form.
+type jsonnetVars struct {
+	ExtStrs  []string `yaml:"extStrs"`
+	ExtCodes []string `yaml:"extCodes"`
+	TLAStrs  []string `yaml:"tlaStrs"`
+	TLACodes []string `yaml:"tlaCodes"`
+}
+
+// readSidecar records the per-file arguments of the sidecar in root, if it
+// has one, for jsonnetArgs to find.
+func readSidecar(j *Jsonnetizer, root string) error {
+	path := filepath.Join(root, sidecarName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var s sidecar
+	err = yaml.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for file, vars := range s.Files {
+		for _, v := range []*[]string{&vars.ExtStrs, &vars.ExtCodes, &vars.TLAStrs, &vars.TLACodes} {
+			*v, err = ResolveExtVars(*v)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", path, file, err)
+			}
+		}
+		j.setFileVars(filepath.Join(root, file), vars)
+	}
+
+	if s.JsonnetBin != "" {
+		bin := s.JsonnetBin
+		if filepath.Base(bin) != bin && !filepath.IsAbs(bin) {
+			bin = filepath.Join(root, bin)
+		}
+		bin, err = exec.LookPath(bin)
+		if err != nil {
+			return fmt.Errorf("%s: couldn't find jsonnetBin: %w", path, err)
+		}
+		j.setRootBin(root, bin)
+	}
+	return nil
+}
+
+func (j *Jsonnetizer) setRootBin(root, bin string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.rootBins == nil {
+		j.rootBins = map[string]string{}
+	}
+	j.rootBins[absPath(root)] = bin
+}
+
+// jsonnetBinFor returns the jsonnet binary file is evaluated with: that of
+// the innermost root with a sidecar giving one which file is under, or the
+// global one.
+func (j *Jsonnetizer) jsonnetBinFor(file string) string {
+	file = absPath(file)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	bin, innermost := j.jsonnetBin(), ""
+	for root, rootBin := range j.rootBins {
+		rel, err := filepath.Rel(root, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(root) > len(innermost) {
+			bin, innermost = rootBin, root
+		}
+	}
+	return bin
+}
+
+func (j *Jsonnetizer) setFileVars(file string, vars jsonnetVars) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.fileVars == nil {
+		j.fileVars = map[string]jsonnetVars{}
+	}
+	j.fileVars[file] = vars
+}
+
+// varsFor returns the variables file is evaluated with: the global ones,
+// overridden by any its sidecar gives it.
+func (j *Jsonnetizer) varsFor(file string) jsonnetVars {
+	j.mu.Lock()
+	local := j.fileVars[file]
+	j.mu.Unlock()
+
+	return jsonnetVars{
+		ExtStrs:  overrideVars(j.ExtStrs, local.ExtStrs),
+		ExtCodes: overrideVars(j.ExtCodes, local.ExtCodes),
+		TLAStrs:  overrideVars(j.TLAStrs, local.TLAStrs),
+		TLACodes: overrideVars(j.TLACodes, local.TLACodes),
+	}
+}
+
+// overrideVars returns vars with every key set by overrides replaced.
+func overrideVars(vars, overrides []string) []string {
+	if len(overrides) == 0 {
+		return vars
+	}
+
+	overridden := map[string]bool{}
+	for _, v := range overrides {
+		overridden[varKey(v)] = true
+	}
+	var merged []string
+	for _, v := range vars {
+		if !overridden[varKey(v)] {
+			merged = append(merged, v)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+func varKey(v string) string {
+	return strings.SplitN(v, "=", 2)[0]
+}
@@ -0,0 +1,77 @@
+package jsonnetize
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessKustomization_Sidecar(t *testing.T) {
+	invocations := fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- a.jsonnet\n- b.jsonnet\n- c.jsonnet\n")
+	writeFile(t, filepath.Join(src, sidecarName), `files:
+  a.jsonnet:
+    extStrs: [env=prod]
+  b.jsonnet:
+    extStrs: [env=dev, region=eu]
+    tlaCodes: [replicas=3]
+`)
+	for _, name := range []string{"a.jsonnet", "b.jsonnet", "c.jsonnet"} {
+		writeFile(t, filepath.Join(src, name), `{}`)
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), ExtStrs: []string{"env=default", "team=web"}, Jobs: 1}
+	assert.NoError(t, processKustomization(context.Background(), &j, nil, src, ""))
+
+	assert.Equal(t, []string{
+		"--ext-str team=web --ext-str env=prod " + filepath.Join(src, "a.jsonnet"),
+		"--ext-str team=web --ext-str env=dev --ext-str region=eu --tla-code replicas=3 " + filepath.Join(src, "b.jsonnet"),
+		"--ext-str env=default --ext-str team=web " + filepath.Join(src, "c.jsonnet"),
+	}, invocations())
+}
+
+func TestProcessKustomization_SidecarJsonnetBin(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), "resources:\n- go\n- scala\n- default.jsonnet\n")
+	writeFile(t, filepath.Join(src, "default.jsonnet"), `{"kind": "Default"}`)
+	for _, team := range []string{"go", "scala"} {
+		dir := filepath.Join(src, team)
+		writeFile(t, filepath.Join(dir, "kustomization.yml"), "resources:\n- app.jsonnet\n- nested\n")
+		writeFile(t, filepath.Join(dir, "app.jsonnet"), `{}`)
+		// nested kustomizations without a sidecar inherit the binary
+		writeFile(t, filepath.Join(dir, "nested", "kustomization.yml"), "resources:\n- lib.jsonnet\n")
+		writeFile(t, filepath.Join(dir, "nested", "lib.jsonnet"), `{}`)
+		writeFile(t, filepath.Join(dir, sidecarName), "jsonnetBin: bin/"+team+"-jsonnet\n")
+		script := "#!/bin/sh\necho '{\"kind\": \"" + team + "\"}'\n"
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", team+"-jsonnet"), []byte(script), 0755))
+	}
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+	for path, expected := range map[string]string{
+		"go/app.jsonnet.yml":           "kind: go\n",
+		"go/nested/lib.jsonnet.yml":    "kind: go\n",
+		"scala/app.jsonnet.yml":        "kind: scala\n",
+		"scala/nested/lib.jsonnet.yml": "kind: scala\n",
+		"default.jsonnet.yml":          "kind: Default\n",
+	} {
+		out, err := ioutil.ReadFile(j.QualifyOutput(src, path))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(out), path)
+	}
+
+	writeFile(t, filepath.Join(src, "go", sidecarName), "jsonnetBin: no-such-jsonnet\n")
+	assert.Error(t, j.Run(context.Background(), src))
+}
+
+func TestOverrideVars(t *testing.T) {
+	assert.Equal(t, []string{"a=1"}, overrideVars([]string{"a=1"}, nil))
+	assert.Equal(t, []string{"b=2", "a=3"}, overrideVars([]string{"a=1", "b=2"}, []string{"a=3"}))
+}
@@ -0,0 +1,101 @@
+package jsonnetize
+
+import "sort"
+
+// TreeNode describes a kustomization processed by a run: every path it refers
+// to, before and after they were replaced by those of their output, and the
+// kustomizations it refers to in turn.
+type TreeNode struct {
+	// Root is the kustomization's root, as it was referred to.
+	Root         string    `json:"root"`
+	Resources    TreePaths `json:"resources"`
+	Components   TreePaths `json:"components"`
+	Bases        TreePaths `json:"bases"`
+	Generators   TreePaths `json:"generators"`
+	Transformers TreePaths `json:"transformers"`
+	// Patches and PatchesJson6902 hold the patches given by path, rewritten
+	// to the output they were processed to even when it was then inlined.
+	// PatchesStrategicMerge includes those given inline, as they are.
+	Patches               TreePaths `json:"patches"`
+	PatchesStrategicMerge TreePaths `json:"patchesStrategicMerge"`
+	PatchesJson6902       TreePaths `json:"patchesJson6902"`
+	Crds                  TreePaths `json:"crds"`
+	OpenAPI               TreePaths `json:"openapi"`
+	// Sources are the files and env files of its configMap and secret
+	// generators, file sources without any key= prefix.
+	Sources TreePaths `json:"sources"`
+	// Children are the kustomizations among its resources, components,
+	// bases, generators and transformers, sorted by root.
+	Children []*TreeNode `json:"children,omitempty"`
+}
+
+// TreePaths holds a list of paths a kustomization refers to as it was
+// written and as it was rewritten, which with Multi may be longer.
+type TreePaths struct {
+	Original  []string `json:"original"`
+	Rewritten []string `json:"rewritten"`
+}
+
+func (p *TreePaths) add(original, rewritten string) {
+	p.Original = append(p.Original, original)
+	p.Rewritten = append(p.Rewritten, rewritten)
+}
+
+// treeRecord is a processed kustomization, keyed by its resolved root and
+// that of the kustomization referring to it, if any.
+type treeRecord struct {
+	parent string
+	node   *TreeNode
+}
+
+// recordTree records node as processed at the end of ancestors, the resolved
+// roots from the first kustomization down to node's. A kustomization referred
+// to by several others is recorded under each of them.
+func (j *Jsonnetizer) recordTree(ancestors []string, node *TreeNode) {
+	var parent string
+	if len(ancestors) > 1 {
+		parent = ancestors[len(ancestors)-2]
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.trees == nil {
+		j.trees = map[[2]string]treeRecord{}
+	}
+	j.trees[[2]string{parent, ancestors[len(ancestors)-1]}] = treeRecord{parent: parent, node: node}
+}
+
+// Tree returns the kustomizations the last Run processed as a tree, from the
+// kustomization it was run on; nil if it processed none. Kustomizations a
+// failure stopped part way through hold the paths already processed.
+func (j *Jsonnetizer) Tree() *TreeNode {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var top *TreeNode
+	children := map[string][]*TreeNode{}
+	resolved := map[*TreeNode]string{}
+	for key, record := range j.trees {
+		node := *record.node
+		resolved[&node] = key[1]
+		if record.parent == "" {
+			top = &node
+			continue
+		}
+		children[record.parent] = append(children[record.parent], &node)
+	}
+	if top == nil {
+		return nil
+	}
+
+	var link func(node *TreeNode)
+	link = func(node *TreeNode) {
+		node.Children = children[resolved[node]]
+		sort.Slice(node.Children, func(a, b int) bool {
+			return node.Children[a].Root < node.Children[b].Root
+		})
+		for _, child := range node.Children {
+			link(child)
+		}
+	}
+	link(top)
+	return top
+}
@@ -0,0 +1,89 @@
+package jsonnetize
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonnetizer_Tree(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "overlay", "kustomization.yml"), "resources:\n- ../base\n- app.jsonnet\ntransformers:\n- labels.yml\n")
+	writeFile(t, filepath.Join(src, "overlay", "app.jsonnet"), `{"kind": "Deployment"}`)
+	writeFile(t, filepath.Join(src, "overlay", "labels.yml"), "kind: LabelTransformer\n")
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- ns.jsonnet\n- ../common\n")
+	writeFile(t, filepath.Join(src, "base", "ns.jsonnet"), `{"kind": "Namespace"}`)
+	writeFile(t, filepath.Join(src, "common", "kustomization.yml"), "generators:\n- gen.jsonnet\n")
+	writeFile(t, filepath.Join(src, "common", "gen.jsonnet"), `{"kind": "ConfigMapGenerator"}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.Nil(t, j.Tree())
+	overlay := filepath.Join(src, "overlay")
+	assert.NoError(t, j.Run(context.Background(), overlay))
+
+	base := filepath.Join(overlay, "../base")
+	assert.Equal(t, &TreeNode{
+		Root:         overlay,
+		Resources:    TreePaths{Original: []string{"../base", "app.jsonnet"}, Rewritten: []string{"../base", "app.jsonnet.yml"}},
+		Transformers: TreePaths{Original: []string{"labels.yml"}, Rewritten: []string{"labels.yml"}},
+		Children: []*TreeNode{{
+			Root:      base,
+			Resources: TreePaths{Original: []string{"ns.jsonnet", "../common"}, Rewritten: []string{"ns.jsonnet.yml", "../common"}},
+			Children: []*TreeNode{{
+				Root:       filepath.Join(base, "../common"),
+				Generators: TreePaths{Original: []string{"gen.jsonnet"}, Rewritten: []string{"gen.jsonnet.yml"}},
+			}},
+		}},
+	}, j.Tree())
+}
+
+func TestJsonnetizer_Tree_EveryPath(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "kustomization.yml"), `bases:
+- base
+patches:
+- path: patch.jsonnet
+- patch: '{"kind": "Inline"}'
+patchesStrategicMerge:
+- merge.yml
+- |-
+  kind: Inline
+patchesJson6902:
+- path: json6902.yml
+  target: {kind: Deployment, name: app}
+crds:
+- crd.jsonnet
+openapi:
+  path: schema.json
+configMapGenerator:
+- name: config
+  files:
+  - key=config.jsonnet
+  envs:
+  - config.env
+`)
+	for _, name := range []string{"patch.jsonnet", "merge.yml", "json6902.yml", "crd.jsonnet", "schema.json", "config.jsonnet", "config.env"} {
+		writeFile(t, filepath.Join(src, name), `{"kind": "A"}`)
+	}
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- ns.yml\n")
+	writeFile(t, filepath.Join(src, "base", "ns.yml"), "kind: Namespace\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	tree := j.Tree()
+	assert.Equal(t, TreePaths{Original: []string{"base"}, Rewritten: []string{"base"}}, tree.Bases)
+	assert.Equal(t, TreePaths{Original: []string{"patch.jsonnet"}, Rewritten: []string{"patch.jsonnet.yml"}}, tree.Patches)
+	assert.Equal(t, TreePaths{Original: []string{"merge.yml", "kind: Inline"}, Rewritten: []string{"merge.yml", "kind: Inline"}}, tree.PatchesStrategicMerge)
+	assert.Equal(t, TreePaths{Original: []string{"json6902.yml"}, Rewritten: []string{"json6902.yml"}}, tree.PatchesJson6902)
+	assert.Equal(t, TreePaths{Original: []string{"crd.jsonnet"}, Rewritten: []string{"crd.jsonnet.yml"}}, tree.Crds)
+	assert.Equal(t, TreePaths{Original: []string{"schema.json"}, Rewritten: []string{"schema.json"}}, tree.OpenAPI)
+	assert.Equal(t, TreePaths{Original: []string{"config.jsonnet", "config.env"}, Rewritten: []string{"config.jsonnet.yml", "config.env"}}, tree.Sources)
+	if assert.Len(t, tree.Children, 1) {
+		assert.Equal(t, filepath.Join(src, "base"), tree.Children[0].Root)
+	}
+}
@@ -0,0 +1,90 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validateResource checks that every document in file has the apiVersion and
+// kind all Kubernetes resources need. Empty documents are ignored.
+func validateResource(j *Jsonnetizer, file string) error {
+	data, err := readOutputFile(j, file)
+	if err != nil {
+		return err
+	}
+	return validateDocuments(data)
+}
+
+// validateResourceList checks that file holds a single ResourceList of the
+// config.kubernetes.io group, as KRM functions exchange, whose items are all
+// Kubernetes resources.
+func validateResourceList(j *Jsonnetizer, file string) error {
+	data, err := readOutputFile(j, file)
+	if err != nil {
+		return err
+	}
+
+	var list struct {
+		APIVersion string      `yaml:"apiVersion"`
+		Kind       string      `yaml:"kind"`
+		Items      []yaml.Node `yaml:"items"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	err = decoder.Decode(&list)
+	if err != nil {
+		return fmt.Errorf("output isn't a ResourceList: %w", err)
+	}
+	var extra interface{}
+	if decoder.Decode(&extra) != io.EOF {
+		return fmt.Errorf("output isn't a ResourceList: it has more than one document")
+	}
+	if list.Kind != "ResourceList" || !strings.HasPrefix(list.APIVersion, "config.kubernetes.io/") {
+		return fmt.Errorf("output isn't a ResourceList: it's apiVersion %q, kind %q rather than config.kubernetes.io/v1, ResourceList", list.APIVersion, list.Kind)
+	}
+	for i, item := range list.Items {
+		out, err := yaml.Marshal(&item)
+		if err != nil {
+			return err
+		}
+		err = validateDocuments(out)
+		if err != nil {
+			return fmt.Errorf("ResourceList item %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validateDocuments checks every document of data as validateResource does.
+func validateDocuments(data []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for i := 0; ; i++ {
+		var value interface{}
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("output isn't valid YAML: %w", err)
+		}
+		if value == nil {
+			continue
+		}
+		doc, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("output document %d isn't a Kubernetes resource: it isn't an object", i)
+		}
+
+		var missing []string
+		for _, field := range []string{"apiVersion", "kind"} {
+			if value, ok := doc[field].(string); !ok || value == "" {
+				missing = append(missing, field)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("output document %d isn't a Kubernetes resource: missing %s", i, strings.Join(missing, " and "))
+		}
+	}
+}
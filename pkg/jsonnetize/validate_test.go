@@ -0,0 +1,75 @@
+package jsonnetize
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateResource(t *testing.T) {
+	dir := t.TempDir()
+	for content, expected := range map[string]string{
+		"apiVersion: v1\nkind: ConfigMap\n":                            "",
+		"apiVersion: v1\nkind: A\n---\n---\napiVersion: v1\nkind: B\n": "",
+		`{"apiVersion": "v1", "kind": "ConfigMap"}`:                    "",
+		"kind: ConfigMap\n":                                            "output document 0 isn't a Kubernetes resource: missing apiVersion",
+		"apiVersion: v1\nkind: A\n---\nfoo: bar\n":                     "output document 1 isn't a Kubernetes resource: missing apiVersion and kind",
+		"- apiVersion: v1\n  kind: A\n":                                "output document 0 isn't a Kubernetes resource: it isn't an object",
+	} {
+		file := filepath.Join(dir, "out.yml")
+		writeFile(t, file, content)
+		err := validateResource(&Jsonnetizer{}, file)
+		if expected == "" {
+			assert.NoError(t, err, content)
+		} else {
+			assert.EqualError(t, err, expected, content)
+		}
+	}
+}
+
+func TestValidateResourceList(t *testing.T) {
+	dir := t.TempDir()
+	for content, expected := range map[string]string{
+		"apiVersion: config.kubernetes.io/v1\nkind: ResourceList\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n": "",
+		"apiVersion: config.kubernetes.io/v1\nkind: ResourceList\nitems: []\n":                                   "",
+		"apiVersion: v1\nkind: ConfigMap\n":                                                                      `output isn't a ResourceList: it's apiVersion "v1", kind "ConfigMap" rather than config.kubernetes.io/v1, ResourceList`,
+		"apiVersion: config.kubernetes.io/v1\nkind: ResourceList\n---\nkind: B\n":                                "output isn't a ResourceList: it has more than one document",
+		"apiVersion: config.kubernetes.io/v1\nkind: ResourceList\nitems:\n- kind: ConfigMap\n":                   "ResourceList item 0: output document 0 isn't a Kubernetes resource: missing apiVersion",
+	} {
+		file := filepath.Join(dir, "out.yml")
+		writeFile(t, file, content)
+		err := validateResourceList(&Jsonnetizer{}, file)
+		if expected == "" {
+			assert.NoError(t, err, content)
+		} else {
+			assert.EqualError(t, err, expected, content)
+		}
+	}
+}
+
+func TestProcessPlugin_KRM(t *testing.T) {
+	fakeJsonnet(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "generator.jsonnet"), `{
+  "apiVersion": "config.kubernetes.io/v1",
+  "kind": "ResourceList",
+  "items": [{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "generated"}}]
+}`)
+	writeFile(t, filepath.Join(src, "plain.jsonnet"), `{"apiVersion": "builtin", "kind": "ConfigMapGenerator"}`)
+	writeFile(t, filepath.Join(src, "copied.yml"), "apiVersion: builtin\nkind: ConfigMapGenerator\n")
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir(), KRM: true}
+	updated, err := processPlugin(context.Background(), &j, nil, src, "generator.jsonnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "generator.jsonnet.yml", updated)
+
+	_, err = processPlugin(context.Background(), &j, nil, src, "plain.jsonnet")
+	assert.EqualError(t, err, `output isn't a ResourceList: it's apiVersion "builtin", kind "ConfigMapGenerator" rather than config.kubernetes.io/v1, ResourceList`)
+
+	// files copied as they are aren't checked
+	updated, err = processPlugin(context.Background(), &j, nil, src, "copied.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, "copied.yml", updated)
+}
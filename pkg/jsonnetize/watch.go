@@ -0,0 +1,122 @@
+package jsonnetize
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch calls rebuild whenever a jsonnet, libsonnet, kustomization or sidecar
+// file changes, until ctx is done. The tree under root is watched, along with
+// the trees of every kustomization the last Run visited, so that bases
+// outside root are covered too. Changes are debounced: rebuild is only called
+// once no further change has been seen for the debounce period.
+func (j *Jsonnetizer) Watch(ctx context.Context, root string, debounce time.Duration, rebuild func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watched := map[string]bool{}
+	watch := func() {
+		for _, dir := range append([]string{root}, j.visitedRoots()...) {
+			err := j.watchTree(watcher, watched, dir)
+			if err != nil {
+				j.logger().Warnf("Couldn't watch %s: %v", dir, err)
+			}
+		}
+	}
+	watch()
+
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if si, err := os.Stat(event.Name); err == nil && si.IsDir() {
+					err = j.watchTree(watcher, watched, event.Name)
+					if err != nil {
+						j.logger().Warnf("Couldn't watch %s: %v", event.Name, err)
+					}
+				}
+			}
+			if !isWatchedFile(event.Name) {
+				continue
+			}
+			j.logger().Debugf("%s changed", event.Name)
+			fire = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			j.logger().Warnf("Watching for changes: %v", err)
+		case <-fire:
+			fire = nil
+			rebuild()
+			// the rebuild may have visited new kustomizations
+			watch()
+		}
+	}
+}
+
+// watchTree adds every directory under dir to watcher, skipping the output
+// tree and hidden directories such as .git.
+func (j *Jsonnetizer) watchTree(watcher *fsnotify.Watcher, watched map[string]bool, dir string) error {
+	output, err := filepath.Abs(j.Output)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if abs == output || (path != dir && strings.HasPrefix(d.Name(), ".")) {
+			return filepath.SkipDir
+		}
+		if watched[abs] {
+			return nil
+		}
+		watched[abs] = true
+		return watcher.Add(abs)
+	})
+}
+
+func isWatchedFile(path string) bool {
+	name := filepath.Base(path)
+	return isJsonnetFile(name) || isLibsonnetFile(name) || isKustFileName(name) || name == sidecarName
+}
+
+func (j *Jsonnetizer) visitRoot(root string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.visited == nil {
+		j.visited = map[string]bool{}
+	}
+	j.visited[root] = true
+}
+
+func (j *Jsonnetizer) visitedRoots() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var roots []string
+	for root := range j.visited {
+		roots = append(roots, root)
+	}
+	return roots
+}
@@ -0,0 +1,60 @@
+package jsonnetize
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonnetizer_Watch(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "overlay", "kustomization.yml"), "resources:\n- ../base\n")
+	writeFile(t, filepath.Join(src, "base", "kustomization.yml"), "resources:\n- a.yml\n")
+	writeFile(t, filepath.Join(src, "base", "a.yml"), `{}`)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	overlay := filepath.Join(src, "overlay")
+	assert.NoError(t, j.Run(context.Background(), overlay))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rebuilds := make(chan struct{}, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- j.Watch(ctx, overlay, 50*time.Millisecond, func() { rebuilds <- struct{}{} })
+	}()
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	expectRebuilds := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case <-rebuilds:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no rebuild")
+			}
+		}
+		select {
+		case <-rebuilds:
+			t.Fatal("unexpected rebuild")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	// a burst of changes to a base outside the watched root is one rebuild
+	for i := 0; i < 3; i++ {
+		writeFile(t, filepath.Join(src, "base", "a.jsonnet"), `{}`)
+	}
+	expectRebuilds(1)
+
+	// files of other kinds are ignored
+	writeFile(t, filepath.Join(src, "base", "a.yml"), `{"kind": "A"}`)
+	expectRebuilds(0)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,478 @@
+package jsonnetize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yaml11Bools are the plain scalars YAML 1.1 parsers, kustomize's among them,
+// read as booleans even though YAML 1.2 leaves them as strings.
+var yaml11Bools = map[string]bool{
+	"y": true, "yes": true, "on": true,
+	"n": true, "no": true, "off": true,
+}
+
+// jsonToYAML converts jsonnet's JSON output into block-style YAML, keeping
+// the order of object fields.
+func jsonToYAML(data []byte) ([]byte, error) {
+	var node yaml.Node
+	err := yaml.Unmarshal(data, &node)
+	if err != nil {
+		return nil, err
+	}
+	if node.Kind == 0 {
+		// empty input
+		return data, nil
+	}
+	blockStyle(&node)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&node)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// yamlStreamToYAML converts the stream of JSON documents jsonnet -y prints
+// into block-style YAML documents.
+func yamlStreamToYAML(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	for {
+		var node yaml.Node
+		err := decoder.Decode(&node)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		blockStyle(&node)
+		err = encoder.Encode(&node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// blockStyle clears the flow styling JSON parses with, quoting any strings a
+// YAML 1.1 parser would otherwise mistake for booleans.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" && yaml11Bools[strings.ToLower(node.Value)] {
+		node.Style = yaml.DoubleQuotedStyle
+	}
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// kustomizationEditor applies rewritten paths to a parsed kustomization
+// document. Edits which simply replace one scalar with another are recorded
+// so they can be spliced into the original bytes; anything which changes the
+// shape of the document forces it to be re-encoded instead.
+type kustomizationEditor struct {
+	edits    []scalarEdit
+	reencode bool
+}
+
+type scalarEdit struct {
+	node *yaml.Node
+	old  string
+}
+
+// rewriteKustomization returns the original kustomization file with the
+// rewritten paths of k in place of the old ones. Every other field, along
+// with comments, ordering and formatting, is kept verbatim. A JSON file stays
+// JSON, though it may be reformatted. Lists are never added or removed, so an
+// absent list stays absent and an empty one empty.
+func rewriteKustomization(original []byte, k *kustomizationFile) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(original, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var mapping *yaml.Node
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		mapping = doc.Content[0]
+	} else {
+		mapping = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{mapping}}
+	}
+	if mapping.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("kustomization is not a mapping")
+	}
+
+	var e kustomizationEditor
+	e.setStrings(mapping, "resources", k.Resources)
+	e.setStrings(mapping, "components", k.Components)
+	e.setStrings(mapping, "bases", k.Bases)
+	e.setStrings(mapping, "generators", k.Generators)
+	e.setStrings(mapping, "transformers", k.Transformers)
+	e.setStrings(mapping, "crds", k.Crds)
+	if openAPI := mappingValue(mapping, "openapi"); openAPI != nil && openAPI.Kind == yaml.MappingNode {
+		if node := mappingValue(openAPI, "path"); node != nil {
+			e.setScalar(node, k.OpenAPI["path"])
+		}
+	}
+
+	var patchPaths, patches, json6902Paths, json6902Patches, strategicMerge []string
+	for _, patch := range k.Patches {
+		patchPaths = append(patchPaths, patch.Path)
+		patches = append(patches, patch.Patch)
+	}
+	for _, patch := range k.PatchesJson6902 {
+		json6902Paths = append(json6902Paths, patch.Path)
+		json6902Patches = append(json6902Patches, patch.Patch)
+	}
+	for _, patch := range k.PatchesStrategicMerge {
+		strategicMerge = append(strategicMerge, string(patch))
+	}
+	e.setPatchPaths(mapping, "patches", patchPaths, patches)
+	e.setPatchPaths(mapping, "patchesJson6902", json6902Paths, json6902Patches)
+	e.setStrings(mapping, "patchesStrategicMerge", strategicMerge)
+
+	var configMapFiles, configMapEnvs, secretFiles, secretEnvs [][]string
+	for _, generator := range k.ConfigMapGenerator {
+		configMapFiles = append(configMapFiles, generator.FileSources)
+		configMapEnvs = append(configMapEnvs, generator.EnvSources)
+	}
+	for _, generator := range k.SecretGenerator {
+		secretFiles = append(secretFiles, generator.FileSources)
+		secretEnvs = append(secretEnvs, generator.EnvSources)
+	}
+	e.setEntryStrings(mapping, "configMapGenerator", "files", configMapFiles)
+	e.setEntryStrings(mapping, "configMapGenerator", "envs", configMapEnvs)
+	e.setEntryStrings(mapping, "secretGenerator", "files", secretFiles)
+	e.setEntryStrings(mapping, "secretGenerator", "envs", secretEnvs)
+
+	if len(e.edits) == 0 && !e.reencode {
+		return original, nil
+	}
+	if !e.reencode {
+		spliced, ok := splice(original, e.edits)
+		if ok {
+			return spliced, nil
+		}
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(original), []byte("{")) {
+		return nodeToJSON(&doc)
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nodeToJSON encodes a parsed document as indented JSON, keeping the order of
+// mapping keys.
+func nodeToJSON(node *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeJSON(&buf, node)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	err = json.Indent(&out, buf.Bytes(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+func writeJSON(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeJSON(buf, node.Content[0])
+	case yaml.AliasNode:
+		return writeJSON(buf, node.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(node.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			err = writeJSON(buf, node.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, child := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeJSON(buf, child)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		var value interface{}
+		err := node.Decode(&value)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func (e *kustomizationEditor) setScalar(node *yaml.Node, value string) {
+	if node.Value == value {
+		return
+	}
+	e.edits = append(e.edits, scalarEdit{node: node, old: node.Value})
+	node.Value = value
+	if strings.Contains(value, "\n") {
+		// which the edit can't be spliced in with anyway
+		node.Style = yaml.LiteralStyle
+	}
+}
+
+// setStrings sets the sequence under key to values, leaving the key out
+// entirely if it was never there and values is empty.
+func (e *kustomizationEditor) setStrings(mapping *yaml.Node, key string, values []string) {
+	seq := mappingValue(mapping, key)
+	if seq == nil {
+		if len(values) == 0 {
+			return
+		}
+		seq = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, seq)
+		e.reencode = true
+	}
+
+	if len(seq.Content) == len(values) {
+		for i, value := range values {
+			e.setScalar(seq.Content[i], value)
+		}
+		return
+	}
+
+	seq.Kind = yaml.SequenceNode
+	seq.Tag = "!!seq"
+	seq.Content = nil
+	for _, value := range values {
+		seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+	}
+	e.reencode = true
+}
+
+// setPatchPaths sets the path of the i-th patch in the sequence under key to
+// paths[i], wherever it has one. A patch whose path is now empty but which has
+// patches[i] has its path replaced by that patch, inline.
+func (e *kustomizationEditor) setPatchPaths(mapping *yaml.Node, key string, paths, patches []string) {
+	seq := mappingValue(mapping, key)
+	if seq == nil || len(seq.Content) != len(paths) {
+		return
+	}
+	for i, entry := range seq.Content {
+		if entry.Kind != yaml.MappingNode {
+			continue
+		}
+		for k := 0; k+1 < len(entry.Content); k += 2 {
+			if entry.Content[k].Value != "path" {
+				continue
+			}
+			if paths[i] == "" && patches[i] != "" {
+				entry.Content[k].Value = "patch"
+				entry.Content[k+1].Tag = "!!str"
+				e.setScalar(entry.Content[k+1], patches[i])
+				e.reencode = true
+			} else {
+				e.setScalar(entry.Content[k+1], paths[i])
+			}
+		}
+	}
+}
+
+// setEntryStrings sets the sequence under field of the i-th mapping in the
+// sequence under key to values[i].
+func (e *kustomizationEditor) setEntryStrings(mapping *yaml.Node, key, field string, values [][]string) {
+	seq := mappingValue(mapping, key)
+	if seq == nil || len(seq.Content) != len(values) {
+		return
+	}
+	for i, entry := range seq.Content {
+		if entry.Kind == yaml.MappingNode {
+			e.setStrings(entry, field, values[i])
+		}
+	}
+}
+
+// splice replaces the source text of each edited scalar within original,
+// reporting false if any of them can't be located reliably.
+func splice(original []byte, edits []scalarEdit) ([]byte, bool) {
+	type span struct {
+		start, end int
+		text       string
+	}
+
+	var lineStarts []int
+	lineStarts = append(lineStarts, 0)
+	for i, c := range original {
+		if c == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+
+	var spans []span
+	for _, edit := range edits {
+		node := edit.node
+		if node.Line < 1 || node.Line > len(lineStarts) || strings.ContainsAny(node.Value, "\n\r") {
+			return nil, false
+		}
+		// columns count characters, not bytes
+		start := lineStarts[node.Line-1]
+		for col := 1; col < node.Column && start < len(original); col++ {
+			_, size := utf8.DecodeRune(original[start:])
+			start += size
+		}
+
+		end, text, ok := scalarSpan(original, start, edit)
+		if !ok {
+			return nil, false
+		}
+		spans = append(spans, span{start, end, text})
+	}
+
+	sort.Slice(spans, func(a, b int) bool { return spans[a].start < spans[b].start })
+	var buf bytes.Buffer
+	last := 0
+	for _, s := range spans {
+		if s.start < last {
+			return nil, false
+		}
+		buf.Write(original[last:s.start])
+		buf.WriteString(s.text)
+		last = s.end
+	}
+	buf.Write(original[last:])
+
+	// make sure the result still parses
+	var check yaml.Node
+	if yaml.Unmarshal(buf.Bytes(), &check) != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// scalarSpan finds the end of the scalar token for node starting at start,
+// along with the replacement text for its new value in the same style.
+func scalarSpan(src []byte, start int, edit scalarEdit) (int, string, bool) {
+	node := edit.node
+	if start >= len(src) {
+		return 0, "", false
+	}
+
+	switch node.Style {
+	case 0:
+		// a plain scalar on a single line is exactly its value
+		if !bytes.HasPrefix(src[start:], []byte(edit.old)) {
+			return 0, "", false
+		}
+		text := node.Value
+		if needsQuoting(text) {
+			text = strconv.Quote(text)
+		}
+		return start + len(edit.old), text, true
+	case yaml.DoubleQuotedStyle:
+		if src[start] != '"' {
+			return 0, "", false
+		}
+		for i := start + 1; i < len(src) && src[i] != '\n'; i++ {
+			switch src[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, strconv.Quote(node.Value), true
+			}
+		}
+	case yaml.SingleQuotedStyle:
+		if src[start] != '\'' {
+			return 0, "", false
+		}
+		for i := start + 1; i < len(src) && src[i] != '\n'; i++ {
+			if src[i] == '\'' {
+				if i+1 < len(src) && src[i+1] == '\'' {
+					i++
+					continue
+				}
+				return i + 1, "'" + strings.ReplaceAll(node.Value, "'", "''") + "'", true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// needsQuoting reports whether value can't be written as a plain scalar
+// string without changing its meaning.
+func needsQuoting(value string) bool {
+	var node yaml.Node
+	if yaml.Unmarshal([]byte(value), &node) != nil || len(node.Content) != 1 {
+		return true
+	}
+	scalar := node.Content[0]
+	return scalar.Kind != yaml.ScalarNode || scalar.Tag != "!!str" || scalar.Value != value || yaml11Bools[strings.ToLower(value)]
+}
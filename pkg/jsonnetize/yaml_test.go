@@ -0,0 +1,193 @@
+package jsonnetize
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+func TestJsonToYAML(t *testing.T) {
+	src := `{"kind": "ConfigMap", "metadata": {"name": "foo"}, "data": {"enabled": "yes", "count": "1", "list": "a\nb"}, "items": [1, 2.5, null, true]}`
+
+	out, err := jsonToYAML([]byte(src))
+	assert.NoError(t, err)
+	assert.Equal(t, `kind: ConfigMap
+metadata:
+  name: foo
+data:
+  enabled: "yes"
+  count: "1"
+  list: |-
+    a
+    b
+items:
+  - 1
+  - 2.5
+  - null
+  - true
+`, string(out))
+
+	var expected, actual interface{}
+	assert.NoError(t, json.Unmarshal([]byte(src), &expected))
+	assert.NoError(t, yaml.Unmarshal(out, &actual))
+	assert.Equal(t, expected.(map[string]interface{})["data"], actual.(map[string]interface{})["data"])
+}
+
+func TestRewriteKustomization(t *testing.T) {
+	original := `# managed by jsonnetize
+namespace: foo
+commonLabels:
+  app: foo
+resources:
+- a.jsonnet   # compiled
+- "b.jsonnet"
+- 'c.jsonnet'
+- plain.yml
+customField:
+  nested: [1, 2]
+patches:
+- path: patch.jsonnet
+  target:
+    kind: Deployment
+- patch: |-
+    - op: remove
+      path: /spec
+`
+	k := types.Kustomization{
+		Resources: []string{"a.jsonnet.yml", "b.jsonnet.yml", "c.jsonnet.yml", "plain.yml"},
+		Patches:   []types.Patch{{Path: "patch.jsonnet.yml"}, {Patch: "- op: remove\n  path: /spec"}},
+	}
+
+	rewritten, err := rewriteKustomization([]byte(original), &kustomizationFile{Kustomization: k})
+	assert.NoError(t, err)
+	assert.Equal(t, `# managed by jsonnetize
+namespace: foo
+commonLabels:
+  app: foo
+resources:
+- a.jsonnet.yml   # compiled
+- "b.jsonnet.yml"
+- 'c.jsonnet.yml'
+- plain.yml
+customField:
+  nested: [1, 2]
+patches:
+- path: patch.jsonnet.yml
+  target:
+    kind: Deployment
+- patch: |-
+    - op: remove
+      path: /spec
+`, string(rewritten))
+}
+
+func TestRewriteKustomization_Reencode(t *testing.T) {
+	original := "namespace: foo\nresources:\n- list.jsonnet\ncustomField: true\n"
+	k := types.Kustomization{
+		Resources:  []string{"list.jsonnet.0.yml", "list.jsonnet.1.yml"},
+		Generators: []string{"gen.yml"},
+	}
+
+	rewritten, err := rewriteKustomization([]byte(original), &kustomizationFile{Kustomization: k})
+	assert.NoError(t, err)
+	assert.Equal(t, `namespace: foo
+resources:
+  - list.jsonnet.0.yml
+  - list.jsonnet.1.yml
+customField: true
+generators:
+  - gen.yml
+`, string(rewritten))
+}
+
+func TestRewriteKustomization_EmptyLists(t *testing.T) {
+	// absent lists stay absent and empty ones empty, whether the document is
+	// spliced or re-encoded
+	for _, resources := range [][]string{nil, {}} {
+		rewritten, err := rewriteKustomization([]byte("resources: []\ncomponents:\n"), &kustomizationFile{Kustomization: types.Kustomization{Resources: resources}})
+		assert.NoError(t, err)
+		assert.Equal(t, "resources: []\ncomponents:\n", string(rewritten))
+	}
+
+	original := `resources: []
+components:
+configMapGenerator:
+- name: a
+  literals:
+  - a=b
+generators:
+- list.jsonnet
+`
+	k := types.Kustomization{
+		Generators:         []string{"list.jsonnet.0.yml", "list.jsonnet.1.yml"},
+		ConfigMapGenerator: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{Name: "a"}}},
+	}
+	rewritten, err := rewriteKustomization([]byte(original), &kustomizationFile{Kustomization: k})
+	assert.NoError(t, err)
+	assert.Equal(t, `resources: []
+components:
+configMapGenerator:
+  - name: a
+    literals:
+      - a=b
+generators:
+  - list.jsonnet.0.yml
+  - list.jsonnet.1.yml
+`, string(rewritten))
+}
+
+func TestProcessKustomization_Golden(t *testing.T) {
+	fakeJsonnet(t)
+	src, err := filepath.Abs(filepath.Join("testdata", "rich"))
+	assert.NoError(t, err)
+
+	j := Jsonnetizer{Base: src, Output: t.TempDir()}
+	assert.NoError(t, j.Run(context.Background(), src))
+
+	// byte for byte the same, but for the compiled paths
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "rich.golden.yaml"))
+	assert.NoError(t, err)
+	rewritten, err := ioutil.ReadFile(j.QualifyOutput(src, "kustomization.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(golden), string(rewritten))
+}
+
+func TestRewriteKustomization_JSON(t *testing.T) {
+	original := `{
+    "namespace": "foo",
+    "resources": ["a.jsonnet", "b.yml"]
+}
+`
+	// same shape: spliced, keeping the formatting
+	k := types.Kustomization{Resources: []string{"a.jsonnet.yml", "b.yml"}}
+	rewritten, err := rewriteKustomization([]byte(original), &kustomizationFile{Kustomization: k})
+	assert.NoError(t, err)
+	assert.Equal(t, `{
+    "namespace": "foo",
+    "resources": ["a.jsonnet.yml", "b.yml"]
+}
+`, string(rewritten))
+
+	// new shape: re-encoded, still as JSON
+	k = types.Kustomization{Resources: []string{"a.jsonnet.0.yml", "a.jsonnet.1.yml", "b.yml"}, Generators: []string{"gen.yml"}}
+	rewritten, err = rewriteKustomization([]byte(original), &kustomizationFile{Kustomization: k})
+	assert.NoError(t, err)
+	assert.Equal(t, `{
+  "namespace": "foo",
+  "resources": [
+    "a.jsonnet.0.yml",
+    "a.jsonnet.1.yml",
+    "b.yml"
+  ],
+  "generators": [
+    "gen.yml"
+  ]
+}
+`, string(rewritten))
+}